@@ -2,51 +2,89 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"lab_1/tcp"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
+// Client talks to one server at a time. With Addr set it connects there
+// and exits when the session ends; otherwise it asks for an address each
+// time. CurrentDir, the working directory if empty, is where files are
+// uploaded from and downloaded to. With User set, the client logs in as
+// soon as it is connected. With TLS set, it connects over TLS.
 type Client struct {
-	Conn       net.Conn
+	Conn       *tcp.Conn
+	Addr       string
 	ServerAddr string
 	CurrentDir string
+	User       string
+	Password   string
+	TLS        *tcp.ClientTLS
 }
 
 func (c *Client) RunClient() {
+	c.CurrentDir, _ = filepath.Abs(c.CurrentDir)
 	for {
 		err := c.initiateConnection()
 		if err != nil {
 			fmt.Println("Failed to connect to server:", err)
+			if c.Addr != "" {
+				return
+			}
 			continue
 		}
 		c.HandleServer()
+		if c.Addr != "" {
+			return
+		}
 	}
 }
 
 func (c *Client) initiateConnection() error {
-	fmt.Print("Enter server address (default: 127.0.0.1:8000): ")
-	_, err := fmt.Scanln(&(c.ServerAddr))
-	if err != nil || c.ServerAddr == "" {
-		c.ServerAddr = "127.0.0.1:8000"
+	if c.Addr != "" {
+		c.ServerAddr = c.Addr
+	} else {
+		fmt.Print("Enter server address (default: 127.0.0.1:8000): ")
+		_, err := fmt.Scanln(&(c.ServerAddr))
+		if err != nil || c.ServerAddr == "" {
+			c.ServerAddr = "127.0.0.1:8000"
+		}
 	}
 
-	c.Conn, err = net.Dial("tcp", c.ServerAddr)
+	conn, err := net.Dial("tcp", c.ServerAddr)
 	if err != nil {
 		return fmt.Errorf("error connecting to server: %v", err)
 	}
 
-	c.CurrentDir, _ = os.Getwd()
-	err = tcp.SetKeepalive(c.Conn)
+	err = tcp.SetKeepalive(conn)
 	if err != nil {
-		_ = c.Conn.Close()
+		_ = conn.Close()
 		return fmt.Errorf("failed to set keepalive: %v", err)
 	}
+	if c.TLS != nil {
+		tlsConn, err := c.TLS.Handshake(conn, c.ServerAddr)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	c.Conn = tcp.NewConn(conn)
 
-	fmt.Printf("Connected to server at %s\n", c.ServerAddr)
+	fmt.Printf("Connected to server at %s%s\n", c.ServerAddr, secured(conn))
+	if c.User != "" {
+		response := c.handleLogin(c.User, c.Password)
+		fmt.Println(response)
+		if strings.HasPrefix(response, "error") {
+			_ = c.Conn.Close()
+			return fmt.Errorf("login failed")
+		}
+	}
 	return nil
 }
 
@@ -70,6 +108,10 @@ func (c *Client) HandleServer() {
 			break
 		}
 		fmt.Println(response)
+		if response == tcp.ShutdownNotice {
+			_ = c.Conn.Close()
+			break
+		}
 	}
 }
 
@@ -78,6 +120,8 @@ func (c *Client) ParseCommand(parts []string) string {
 	args := parts[1:]
 
 	switch cmd {
+	case "login":
+		return c.handleLogin(args...)
 	case "echo":
 		return c.handleEcho(args...)
 	case "time":
@@ -88,10 +132,16 @@ func (c *Client) ParseCommand(parts []string) string {
 		return c.handleLs()
 	case "cd":
 		return c.handleCd(args...)
+	case "pwd", "mkdir", "rm", "rmdir", "mv", "rename", "cp", "stat":
+		return c.handleFileCommand(cmd, args...)
 	case "download":
 		return c.HandleDownload(args...)
 	case "upload":
 		return c.HandleUpload(args...)
+	case "reget":
+		return c.HandleResumeDownload(args...)
+	case "reput":
+		return c.HandleResumeUpload(args...)
 	case "cls":
 		return fmt.Sprintf("Client local directory: %s", c.CurrentDir)
 	default:
@@ -99,6 +149,30 @@ func (c *Client) ParseCommand(parts []string) string {
 	}
 }
 
+// secured notes a TLS connection and its version.
+func secured(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	return " over " + tls.VersionName(tlsConn.ConnectionState().Version)
+}
+
+func (c *Client) handleLogin(args ...string) string {
+	if len(args) != 2 {
+		return "error: usage: login <name> <password>"
+	}
+	err := tcp.SendData(c.Conn, "login "+args[0]+" "+args[1])
+	if err != nil {
+		return fmt.Sprintf("error sending login command: %v", err)
+	}
+	response, err := tcp.ReadData(c.Conn)
+	if err != nil {
+		return fmt.Sprintf("error reading login response: %v", err)
+	}
+	return response
+}
+
 func (c *Client) handleEcho(args ...string) string {
 	command := "echo " + strings.Join(args, " ")
 	err := tcp.SendData(c.Conn, command)
@@ -161,12 +235,26 @@ func (c *Client) handleCd(args ...string) string {
 	return fmt.Sprintf("%s", response)
 }
 
+// handleFileCommand runs one of the file management commands, which the
+// server checks and answers in one response.
+func (c *Client) handleFileCommand(cmd string, args ...string) string {
+	err := tcp.SendData(c.Conn, strings.Join(append([]string{cmd}, args...), " "))
+	if err != nil {
+		return fmt.Sprintf("error sending %s command: %v", cmd, err)
+	}
+	response, err := tcp.ReadData(c.Conn)
+	if err != nil {
+		return fmt.Sprintf("error reading %s response: %v", cmd, err)
+	}
+	return response
+}
+
 func (c *Client) HandleDownload(args ...string) string {
 	if len(args) == 0 {
 		return "error: file name required"
 	}
 	remoteFileName := args[0]
-	localFileName := remoteFileName
+	localFileName := path.Base(remoteFileName)
 	if len(args) > 1 {
 		localFileName = args[1]
 	}
@@ -175,9 +263,12 @@ func (c *Client) HandleDownload(args ...string) string {
 		return fmt.Sprintf("error sending download command: %v", err)
 	}
 
-	tcp.Download(c.CurrentDir, c.Conn, localFileName)
+	localPath, err := tcp.Download(c.CurrentDir, c.Conn, localFileName)
+	if err != nil {
+		return fmt.Sprintf("error: download failed: %v", err)
+	}
 
-	return fmt.Sprintf("file downloaded to: %s", filepath.Join(c.CurrentDir, localFileName))
+	return fmt.Sprintf("file downloaded to: %s", localPath)
 }
 
 func (c *Client) HandleUpload(args ...string) string {
@@ -194,7 +285,85 @@ func (c *Client) HandleUpload(args ...string) string {
 		return fmt.Sprintf("error sending upload command: %v", err)
 	}
 
-	tcp.Upload(c.CurrentDir, c.Conn, localFileName)
+	uploadErr := tcp.Upload(c.CurrentDir, c.Conn, localFileName)
+	return c.uploadResult(uploadErr, remoteFileName)
+}
+
+// HandleResumeDownload continues a download into an existing partial
+// local file, asking the server to start at its current size.
+func (c *Client) HandleResumeDownload(args ...string) string {
+	if len(args) == 0 {
+		return "error: file name required"
+	}
+	remoteFileName := args[0]
+	localFileName := path.Base(remoteFileName)
+	if len(args) > 1 {
+		localFileName = args[1]
+	}
+
+	var offset int64
+	if info, err := os.Stat(filepath.Join(c.CurrentDir, localFileName)); err == nil {
+		offset = info.Size()
+	}
+	err := tcp.SendData(c.Conn, fmt.Sprintf("download %s %d", remoteFileName, offset))
+	if err != nil {
+		return fmt.Sprintf("error sending download command: %v", err)
+	}
+
+	localPath, err := tcp.Download(c.CurrentDir, c.Conn, localFileName)
+	if err != nil {
+		return fmt.Sprintf("error: download failed: %v", err)
+	}
+
+	return fmt.Sprintf("file downloaded to: %s", localPath)
+}
+
+// HandleResumeUpload continues an upload into an existing partial remote
+// file, starting from the size the server reports for it.
+func (c *Client) HandleResumeUpload(args ...string) string {
+	if len(args) == 0 {
+		return "error: file name required"
+	}
+	localFileName := args[0]
+	remoteFileName := localFileName
+	if len(args) > 1 {
+		remoteFileName = args[1]
+	}
+
+	err := tcp.SendData(c.Conn, "size "+remoteFileName)
+	if err != nil {
+		return fmt.Sprintf("error sending size command: %v", err)
+	}
+	response, err := tcp.ReadData(c.Conn)
+	if err != nil {
+		return fmt.Sprintf("error reading size response: %v", err)
+	}
+	offset := "0"
+	if !strings.HasPrefix(response, "error") {
+		offset = response
+	}
+
+	err = tcp.SendData(c.Conn, "upload "+remoteFileName)
+	if err != nil {
+		return fmt.Sprintf("error sending upload command: %v", err)
+	}
+
+	uploadErr := tcp.Upload(c.CurrentDir, c.Conn, localFileName, offset)
+	return c.uploadResult(uploadErr, remoteFileName)
+}
 
+// uploadResult reads the server's verdict on an upload. The server answers
+// even when the local side failed, so the reply is always consumed.
+func (c *Client) uploadResult(uploadErr error, remoteFileName string) string {
+	response, err := tcp.ReadData(c.Conn)
+	if uploadErr != nil {
+		return fmt.Sprintf("error: upload failed: %v", uploadErr)
+	}
+	if err != nil {
+		return fmt.Sprintf("error reading upload response: %v", err)
+	}
+	if response != "upload complete" {
+		return response
+	}
 	return fmt.Sprintf("file uploaded as: %s", remoteFileName)
 }
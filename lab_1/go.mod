@@ -1,3 +1,5 @@
 module lab_1
 
 go 1.24
+
+require golang.org/x/crypto v0.22.0
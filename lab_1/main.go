@@ -1,29 +1,179 @@
 package main
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
+	"lab_1/auth"
 	"lab_1/client"
+	"lab_1/config"
 	"lab_1/server"
+	"lab_1/tcp"
 	"os"
+	"strings"
+	"time"
 )
 
+const usage = `usage:
+  lab_1 serve [flags]            run the server (alias -s)
+  lab_1 connect [flags] [addr]   run the client (alias -c)
+  lab_1 adduser [flags] name     add a user to the users file, or change
+                                 one; the password is read from stdin
+  lab_1 gencert [flags] [host...]
+                                 write a self-signed TLS certificate for
+                                 the hosts (default localhost 127.0.0.1)
+
+Settings come from defaults, then the JSON file given by -config or $%s,
+then NSSDS_* environment variables, then flags. Run a command with -h for
+its flags.
+`
+
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("use flag -c for running client or -s for running server")
+		fmt.Printf(usage, config.EnvFile)
 		os.Exit(1)
 	}
 
 	mode := os.Args[1]
 	switch mode {
-	case "-s":
-		s := new(server.Server)
+	case "serve", "-s":
+		flags, cfg := loadConfig("serve", os.Args[2:], func(flags *flag.FlagSet, cfg *config.Config) {
+			flags.StringVar(&cfg.Server.Listen, "listen", cfg.Server.Listen, "address to listen on")
+			flags.StringVar(&cfg.Server.Root, "root", cfg.Server.Root, "directory to serve")
+			flags.DurationVar((*time.Duration)(&cfg.Server.DrainTimeout), "drain-timeout", time.Duration(cfg.Server.DrainTimeout), "how long a shutdown waits for running transfers")
+			flags.StringVar(&cfg.Server.Users, "users", cfg.Server.Users, "users file; without one no login is required")
+			flags.StringVar(&cfg.Server.TLSCert, "tls-cert", cfg.Server.TLSCert, "TLS certificate; with -tls-key, serve only TLS")
+			flags.StringVar(&cfg.Server.TLSKey, "tls-key", cfg.Server.TLSKey, "TLS private key")
+			flags.StringVar(&cfg.Server.TLSClientCA, "tls-client-ca", cfg.Server.TLSClientCA, "require client certificates signed by these CAs")
+		})
+		if flags.NArg() > 0 {
+			fmt.Printf("unexpected argument: %s\n", flags.Arg(0))
+			os.Exit(1)
+		}
+		server.DrainTimeout = time.Duration(cfg.Server.DrainTimeout)
+		s := &server.Server{ServerAddr: cfg.Server.Listen, Root: cfg.Server.Root}
+		if cfg.Server.Users != "" {
+			users, err := auth.Load(cfg.Server.Users)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			s.Users = users
+		}
+		if cfg.Server.TLSCert != "" {
+			tlsConfig, err := tcp.ServerTLSConfig(cfg.Server.TLSCert, cfg.Server.TLSKey, cfg.Server.TLSClientCA)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			s.TLS = tlsConfig
+		}
 		s.RunServer()
-	case "-c":
-		c := new(client.Client)
+	case "connect", "-c":
+		flags, cfg := loadConfig("connect", os.Args[2:], func(flags *flag.FlagSet, cfg *config.Config) {
+			flags.StringVar(&cfg.Client.Dir, "dir", cfg.Client.Dir, "local directory for uploads and downloads")
+			flags.StringVar(&cfg.Client.User, "user", cfg.Client.User, "log in as this user, with the password from $NSSDS_PASSWORD or the config")
+			flags.BoolVar(&cfg.Client.TLS, "tls", cfg.Client.TLS, "connect over TLS, trusting the server's certificate on first use")
+			flags.StringVar(&cfg.Client.TLSCA, "tls-ca", cfg.Client.TLSCA, "verify the server's certificate against these CAs")
+			flags.StringVar(&cfg.Client.TLSPin, "tls-pin", cfg.Client.TLSPin, "accept only the server certificate with this SHA-256 fingerprint")
+			flags.StringVar(&cfg.Client.TLSCert, "tls-cert", cfg.Client.TLSCert, "client certificate, for servers that require one")
+			flags.StringVar(&cfg.Client.TLSKey, "tls-key", cfg.Client.TLSKey, "client private key")
+			flags.StringVar(&cfg.Client.KnownHosts, "known-hosts", cfg.Client.KnownHosts, "certificates trusted on first use (default ~/.nssds_known_hosts)")
+		})
+		if flags.NArg() > 0 {
+			cfg.Client.Addr = flags.Arg(0)
+		}
+		c := &client.Client{Addr: cfg.Client.Addr, CurrentDir: cfg.Client.Dir, User: cfg.Client.User, Password: cfg.Client.Password}
+		if cfg.Client.UsesTLS() {
+			c.TLS = &tcp.ClientTLS{
+				CAFile:     cfg.Client.TLSCA,
+				Pin:        cfg.Client.TLSPin,
+				CertFile:   cfg.Client.TLSCert,
+				KeyFile:    cfg.Client.TLSKey,
+				KnownHosts: cfg.Client.KnownHosts,
+			}
+		}
 		c.RunClient()
+	case "adduser":
+		role, home := string(auth.ReadWrite), ""
+		flags, cfg := loadConfig("adduser", os.Args[2:], func(flags *flag.FlagSet, cfg *config.Config) {
+			flags.StringVar(&cfg.Server.Users, "users", cfg.Server.Users, "users file")
+			flags.StringVar(&role, "role", role, "ro for read-only, rw for read-write")
+			flags.StringVar(&home, "home", home, "home directory under the server root (default /<name>)")
+		})
+		if flags.NArg() != 1 || cfg.Server.Users == "" {
+			fmt.Println("usage: adduser -users FILE [-role ro|rw] [-home DIR] name")
+			os.Exit(1)
+		}
+		name := flags.Arg(0)
+		if home == "" {
+			home = "/" + name
+		}
+		fmt.Print("Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			fmt.Printf("\nerror: no password given (%v)\n", err)
+			os.Exit(1)
+		}
+		if err := auth.AddUser(cfg.Server.Users, name, password, auth.Role(role), home); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("user %s saved to %s\n", name, cfg.Server.Users)
+	case "gencert":
+		certFile, keyFile, days := "server.crt", "server.key", 365
+		flags := flag.NewFlagSet("gencert", flag.ExitOnError)
+		flags.StringVar(&certFile, "cert", certFile, "certificate file to write")
+		flags.StringVar(&keyFile, "key", keyFile, "private key file to write")
+		flags.IntVar(&days, "days", days, "days the certificate is valid")
+		_ = flags.Parse(os.Args[2:])
+		hosts := flags.Args()
+		if len(hosts) == 0 {
+			hosts = []string{"localhost", "127.0.0.1"}
+		}
+		fingerprint, err := tcp.GenerateCert(certFile, keyFile, hosts, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("certificate for %s written to %s, key to %s\n", strings.Join(hosts, ", "), certFile, keyFile)
+		fmt.Printf("fingerprint (for -tls-pin): %s\n", fingerprint)
+	case "-h", "-help", "--help", "help":
+		fmt.Printf(usage, config.EnvFile)
 	default:
-		fmt.Printf("unknown argument: %s\n", mode)
+		fmt.Printf("unknown command: %s\n", mode)
+		fmt.Printf(usage, config.EnvFile)
+		os.Exit(1)
+	}
+
+}
+
+// loadConfig builds the settings of a command. define binds the command's
+// own flags to cfg. The flags are parsed twice: first to find -config, then
+// again over the loaded config so that they take precedence over it.
+func loadConfig(name string, args []string, define func(*flag.FlagSet, *config.Config)) (*flag.FlagSet, config.Config) {
+	cfg := config.Default()
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	path := flags.String("config", os.Getenv(config.EnvFile), "JSON config file")
+	flags.DurationVar((*time.Duration)(&cfg.Keepalive), "keepalive", time.Duration(cfg.Keepalive), "TCP keepalive idle time")
+	flags.IntVar(&cfg.BufferSize, "buffer-size", cfg.BufferSize, "largest data frame sent, in bytes")
+	define(flags, &cfg)
+	_ = flags.Parse(args)
+
+	loaded, err := config.Load(*path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cfg = loaded
+	_ = flags.Parse(args)
+	if err := cfg.Validate(); err != nil {
+		fmt.Printf("error in config: %v\n", err)
 		os.Exit(1)
 	}
 
+	tcp.KeepaliveIdle = time.Duration(cfg.Keepalive)
+	tcp.BufferSize = cfg.BufferSize
+	return flags, cfg
 }
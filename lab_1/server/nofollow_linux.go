@@ -0,0 +1,6 @@
+package server
+
+import "syscall"
+
+// noFollow makes opening a symlink fail rather than open what it points to.
+const noFollow = syscall.O_NOFOLLOW
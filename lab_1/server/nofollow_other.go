@@ -0,0 +1,7 @@
+//go:build !linux
+
+package server
+
+// noFollow is not available everywhere off Linux; there the callers'
+// Lstat checks have to do.
+const noFollow = 0
@@ -1,21 +1,39 @@
 package server
 
 import (
-	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"lab_1/auth"
 	"lab_1/tcp"
 	"net"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 )
 
+// Server serves one client at a time. ServerAddr is the address to listen
+// on, 127.0.0.1 and tcp.Port if empty, and Root the directory served, the
+// working directory if empty. Clients cannot leave Root: they see it as
+// "/", and CurrentDir is the client's directory under it. With Users set,
+// clients must log in, and then see only their home directory. With TLS
+// set, every connection starts with a TLS handshake.
 type Server struct {
-	Conn       net.Conn
+	Conn       *tcp.Conn
 	ClientAddr string
 	ServerAddr string
+	Root       string
+	Users      *auth.Users
+	TLS        *tls.Config
 	CurrentDir string
+	jail       *Jail
+	clients    *clientSet
+
+	// The logged-in client: its user, the jail of its home and how many
+	// logins it has failed.
+	user     *auth.User
+	home     *Jail
+	failures int
 }
 
 func (s *Server) RunServer() {
@@ -25,8 +43,14 @@ func (s *Server) RunServer() {
 		return
 	}
 
-	s.CurrentDir, _ = os.Getwd()
-	s.ServerAddr = fmt.Sprintf("127.0.0.1:%d", tcp.Port)
+	s.jail, err = NewJail(s.Root)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	if s.ServerAddr == "" {
+		s.ServerAddr = fmt.Sprintf("127.0.0.1:%d", tcp.Port)
+	}
 	ln, err := net.Listen("tcp", s.ServerAddr)
 	if err != nil {
 		fmt.Printf("error starting server: %v\n", err)
@@ -36,25 +60,43 @@ func (s *Server) RunServer() {
 	defer func(ln net.Listener) {
 		_ = ln.Close()
 	}(ln)
-	fmt.Printf("server started on address %s and port %d\n", address, tcp.Port)
+	fmt.Printf("server started on address %s, listening on %s, serving %s\n", address, ln.Addr(), s.jail.Root)
+	announceUsers(s.Users)
+	announceTLS(s.TLS)
+	s.clients = newClientSet()
+	go s.awaitShutdown(ln)
 
 	for {
-		s.Conn, err = ln.Accept()
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			fmt.Println("server stopped")
+			return
+		}
 		if err != nil {
 			fmt.Printf("error accepting connection: %v\n", err)
 			continue
 		}
 
-		if err := tcp.SetKeepalive(s.Conn); err != nil {
+		if err := tcp.SetKeepalive(conn); err != nil {
 			fmt.Printf("error setting keepalive: %v\n", err)
-			_ = s.Conn.Close()
+			_ = conn.Close()
 			continue
 		}
+		if s.TLS != nil {
+			tlsConn, err := tcp.ServerHandshake(conn, s.TLS)
+			if err != nil {
+				fmt.Printf("connection from %s refused: %v\n", conn.RemoteAddr(), err)
+				_ = conn.Close()
+				continue
+			}
+			conn = tlsConn
+		}
+		s.Conn = tcp.NewConn(conn)
 		s.HandleClient(s.Conn)
 	}
 }
 
-func (s *Server) HandleClient(conn net.Conn) {
+func (s *Server) HandleClient(conn *tcp.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Printf("recovered from panic in client handler: %v\n", r)
@@ -62,29 +104,41 @@ func (s *Server) HandleClient(conn net.Conn) {
 		_ = conn.Close()
 	}()
 	s.ClientAddr = conn.RemoteAddr().String()
-	fmt.Printf("new connection from %s\n", s.ClientAddr)
+	s.CurrentDir = "/"
+	s.user, s.home, s.failures = nil, s.jail, 0
+	fmt.Printf("new connection from %s%s\n", s.ClientAddr, peer(conn))
+	if !s.clients.add(conn) {
+		return
+	}
+	defer s.clients.remove(conn)
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		command := scanner.Text()
+	for {
+		command, err := tcp.ReadData(conn)
+		if err != nil {
+			fmt.Printf("client %s disconnected: %v\n", s.ClientAddr, err)
+			return
+		}
 		parts := strings.Fields(command)
 		if len(parts) == 0 {
 			continue
 		}
-		fmt.Printf("[%s] command: %s\n", s.ClientAddr, command)
+		if !s.clients.begin(conn) {
+			return
+		}
+		fmt.Printf("[%s] command: %s\n", s.ClientAddr, redact(command))
 		response := s.ParseCommand(parts)
 		if response != "" {
 			if err := tcp.SendData(conn, response); err != nil {
 				fmt.Printf("error sending response to %s: %v\n", s.ClientAddr, err)
 				return
 			}
-			if response == "goodbye!" {
+			if response == "goodbye!" || response == LoginLimitNotice {
 				return
 			}
 		}
-	}
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("client %s disconnected with error: %v\n", s.ClientAddr, err)
+		if !s.clients.end(conn) {
+			return
+		}
 	}
 }
 
@@ -92,8 +146,17 @@ func (s *Server) ParseCommand(parts []string) string {
 	cmd := strings.ToLower(parts[0])
 	args := parts[1:]
 
+	if denied := authorize(s.Users, s.user, cmd); denied != "" {
+		if cmd == "upload" {
+			_ = tcp.Discard(s.Conn)
+		}
+		return denied
+	}
+
 	response := ""
 	switch cmd {
+	case "login":
+		response = s.handleLogin(args...)
 	case "echo":
 		response = handleEcho(args...)
 	case "time":
@@ -101,19 +164,73 @@ func (s *Server) ParseCommand(parts []string) string {
 	case "quit", "exit", "close":
 		response = "goodbye!"
 	case "ls":
-		response = handleLs(s.CurrentDir)
+		response = handleLs(s.home, s.CurrentDir)
 	case "cd":
-		response = handleCd(&s.CurrentDir, args...)
+		response = handleCd(s.home, &s.CurrentDir, args...)
+	case "size":
+		response = handleSize(s.home, s.CurrentDir, args...)
+	case "pwd":
+		response = handlePwd(s.CurrentDir)
+	case "mkdir":
+		response = handleMkdir(s.home, s.CurrentDir, args...)
+	case "rm":
+		response = handleRm(s.home, s.CurrentDir, args...)
+	case "rmdir":
+		response = handleRmdir(s.home, s.CurrentDir, args...)
+	case "mv", "rename":
+		response = handleMv(s.home, s.CurrentDir, args...)
+	case "cp":
+		response = handleCp(s.home, s.CurrentDir, args...)
+	case "stat":
+		response = handleStat(s.home, s.CurrentDir, args...)
 	case "download":
-		tcp.Upload(s.CurrentDir, s.Conn, args...)
+		dir, args, err := s.home.fileArgs(s.CurrentDir, args)
+		if err != nil {
+			fmt.Printf("[%s] download refused: %v\n", s.ClientAddr, err)
+			_ = tcp.SendData(s.Conn, fmt.Sprintf("error: %v", err))
+			break
+		}
+		if err := tcp.Upload(dir, s.Conn, args...); err != nil {
+			fmt.Printf("[%s] download failed: %v\n", s.ClientAddr, err)
+		}
 	case "upload":
-		tcp.Download(s.CurrentDir, s.Conn, args...)
+		response = "upload complete"
+		dir, args, err := s.home.fileArgs(s.CurrentDir, args)
+		if err != nil {
+			fmt.Printf("[%s] upload refused: %v\n", s.ClientAddr, err)
+			_ = tcp.Discard(s.Conn)
+			response = fmt.Sprintf("error: upload failed: %v", err)
+			break
+		}
+		if _, err := tcp.Download(dir, s.Conn, args...); err != nil {
+			fmt.Printf("[%s] upload failed: %v\n", s.ClientAddr, err)
+			response = s.home.Hide(fmt.Sprintf("error: upload failed: %v", err))
+		}
 	default:
 		response = "error: unknown command"
 	}
 	return response
 }
 
+// handleLogin logs the client in and moves it to its home directory.
+func (s *Server) handleLogin(args ...string) string {
+	if s.Users == nil {
+		return "error: this server does not require a login"
+	}
+	user, home, err := login(s.Users, s.jail, args)
+	if err != nil {
+		s.failures++
+		fmt.Printf("[%s] login failed: %v\n", s.ClientAddr, err)
+		if s.failures >= MaxLoginAttempts {
+			return LoginLimitNotice
+		}
+		return fmt.Sprintf("error: %v", err)
+	}
+	s.user, s.home, s.CurrentDir, s.failures = user, home, "/", 0
+	fmt.Printf("[%s] logged in as %s (%s)\n", s.ClientAddr, user.Name, user.Role)
+	return fmt.Sprintf("logged in as %s (%s)", user.Name, user.Role)
+}
+
 func handleEcho(args ...string) string {
 	return strings.Join(args, " ")
 }
@@ -122,10 +239,14 @@ func handleTime() string {
 	return time.Now().Format("15:04:05.000")
 }
 
-func handleLs(dir string) string {
+func handleLs(jail *Jail, currentDir string) string {
+	dir, _, err := jail.Resolve(currentDir, ".")
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
 	files, err := os.ReadDir(dir)
 	if err != nil {
-		return fmt.Sprintf("error reading directory '%s': %v", dir, err)
+		return fmt.Sprintf("error reading directory '%s'", currentDir)
 	}
 
 	var result []string
@@ -143,22 +264,37 @@ func handleLs(dir string) string {
 	return strings.Join(result, "   ")
 }
 
-func handleCd(currentDir *string, args ...string) string {
+func handleCd(jail *Jail, currentDir *string, args ...string) string {
 	if len(args) == 0 {
 		return "error: path required"
 	}
 
-	newPath := filepath.Join(*currentDir, args[0])
-	absPath, err := filepath.Abs(newPath)
+	realPath, newDir, err := jail.Resolve(*currentDir, args[0])
 	if err != nil {
-		return fmt.Sprintf("error getting absolute path: %v", err)
+		return fmt.Sprintf("error: %v", err)
 	}
 
-	info, err := os.Stat(absPath)
+	info, err := os.Stat(realPath)
 	if err != nil || !info.IsDir() {
-		return fmt.Sprintf("error: path does not exist or is not a directory: %s", absPath)
+		return fmt.Sprintf("error: path does not exist or is not a directory: %s", newDir)
+	}
+
+	*currentDir = newDir
+	return fmt.Sprintf("changed directory to %s", newDir)
+}
+
+func handleSize(jail *Jail, currentDir string, args ...string) string {
+	if len(args) == 0 {
+		return "error: file name required"
 	}
 
-	*currentDir = absPath
-	return fmt.Sprintf("changed directory to %s", absPath)
+	realPath, _, err := jail.Resolve(currentDir, args[0])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	info, err := os.Stat(realPath)
+	if err != nil || info.IsDir() {
+		return fmt.Sprintf("error: file does not exist: %s", args[0])
+	}
+	return fmt.Sprintf("%d", info.Size())
 }
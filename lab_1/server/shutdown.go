@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"lab_1/tcp"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DrainTimeout is how long a shutdown lets a running command, a transfer
+// in particular, finish before its client is cut off.
+var DrainTimeout = 30 * time.Second
+
+// NoticeTimeout bounds writes of shutdown notices.
+const NoticeTimeout = 100 * time.Millisecond
+
+// clientSet tracks the clients being served so a shutdown can reach them.
+// A client is busy from reading a command until it has been answered: idle
+// clients are told about the shutdown and disconnected at once, busy ones
+// as soon as they are done.
+type clientSet struct {
+	clients  map[*tcp.Conn]bool // busy
+	draining bool
+	mu       sync.Mutex
+}
+
+func newClientSet() *clientSet {
+	return &clientSet{clients: make(map[*tcp.Conn]bool)}
+}
+
+// add registers an idle client. It returns false if the server is already
+// shutting down, in which case conn has been told and closed.
+func (c *clientSet) add(conn *tcp.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		notice(conn, tcp.ShutdownNotice)
+		_ = conn.Close()
+		return false
+	}
+	c.clients[conn] = false
+	return true
+}
+
+func (c *clientSet) remove(conn *tcp.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.clients, conn)
+}
+
+// begin marks the client busy with a command it has just sent. It returns
+// false if the shutdown disconnected it first; the command is then dropped.
+func (c *clientSet) begin(conn *tcp.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.clients[conn]; !ok {
+		return false
+	}
+	c.clients[conn] = true
+	return true
+}
+
+// end marks the client idle once its command is answered. It returns false
+// if the server started shutting down meanwhile: the client has then been
+// told and disconnected.
+func (c *clientSet) end(conn *tcp.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.clients[conn]; !ok {
+		return false
+	}
+	if c.draining {
+		delete(c.clients, conn)
+		notice(conn, tcp.ShutdownNotice)
+		_ = conn.Close()
+		return false
+	}
+	c.clients[conn] = false
+	return true
+}
+
+// drain starts a shutdown: idle clients are told and disconnected, and the
+// busy ones will be when they are done. It returns how many are busy.
+func (c *clientSet) drain() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+	for conn, busy := range c.clients {
+		if !busy {
+			delete(c.clients, conn)
+			notice(conn, tcp.ShutdownNotice)
+			_ = conn.Close()
+		}
+	}
+	return len(c.clients)
+}
+
+// cutOff disconnects the clients still busy, failing their transfers, and
+// returns how many there were.
+func (c *clientSet) cutOff() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.clients)
+	for conn := range c.clients {
+		delete(c.clients, conn)
+		_ = conn.Close()
+	}
+	return n
+}
+
+// awaitShutdown waits for SIGINT or SIGTERM and stops the server: the
+// listener is closed, which ends the accept loop, the connected client is
+// drained and, after DrainTimeout or a second signal, cut off if it is
+// still busy. An upload cut off this way keeps its partial file, so it can
+// be finished with "reput" once the server is back.
+func (s *Server) awaitShutdown(ln net.Listener) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	sig := <-signals
+	fmt.Printf("received %v, shutting down\n", sig)
+	_ = ln.Close()
+	if busy := s.clients.drain(); busy > 0 {
+		fmt.Printf("waiting up to %s for the busy client\n", DrainTimeout)
+	}
+
+	select {
+	case <-time.After(DrainTimeout):
+	case sig = <-signals:
+		fmt.Printf("received %v again\n", sig)
+	}
+	if n := s.clients.cutOff(); n > 0 {
+		fmt.Println("cut off the busy client")
+	}
+}
+
+// notice sends a line to a client that is not waiting for an answer,
+// giving up quickly on one that is not reading.
+func notice(conn *tcp.Conn, message string) {
+	_ = conn.SetWriteDeadline(time.Now().Add(NoticeTimeout))
+	_ = tcp.SendData(conn, message)
+	_ = conn.SetWriteDeadline(time.Time{})
+}
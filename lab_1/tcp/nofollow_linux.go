@@ -0,0 +1,6 @@
+package tcp
+
+import "syscall"
+
+// noFollow makes opening a symlink fail rather than open what it points to.
+const noFollow = syscall.O_NOFOLLOW
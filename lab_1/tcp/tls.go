@@ -0,0 +1,277 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HandshakeTimeout bounds the TLS handshake, so a client that connects
+// and then says nothing cannot hold the server up.
+var HandshakeTimeout = 10 * time.Second
+
+// ServerTLSConfig loads the server's certificate and key. With clientCA
+// set, clients must present a certificate signed by one of the
+// certificates in that file.
+func ServerTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pool, err := loadPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ServerHandshake runs the server side of the TLS handshake on conn.
+func ServerHandshake(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, config)
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return tlsConn, nil
+}
+
+// PeerName returns the common name of the client certificate on conn, or
+// "" if there is none.
+func PeerName(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		return certs[0].Subject.CommonName
+	}
+	return ""
+}
+
+// ClientTLS says how a client checks the server's certificate: against
+// CAFile if set, otherwise against Pin, a SHA-256 fingerprint as printed
+// by Fingerprint or openssl, if set, and otherwise by trusting it on first
+// use and remembering it in KnownHosts (~/.nssds_known_hosts if empty).
+// CertFile and KeyFile are the client's own certificate, for servers that
+// require one.
+type ClientTLS struct {
+	CAFile     string
+	Pin        string
+	CertFile   string
+	KeyFile    string
+	KnownHosts string
+}
+
+// Handshake runs the client side of the TLS handshake on conn, a
+// connection to addr.
+func (t *ClientTLS) Handshake(conn net.Conn, addr string) (*tls.Conn, error) {
+	config, err := t.config(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return tlsConn, nil
+}
+
+func (t *ClientTLS) config(addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %v", addr, err)
+	}
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch {
+	case t.CAFile != "":
+		config.RootCAs, err = loadPool(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	case t.Pin != "":
+		// The pin replaces the usual checks: it names the one
+		// certificate that is accepted.
+		config.InsecureSkipVerify = true
+		pin := normalizeFingerprint(t.Pin)
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if got := Fingerprint(state.PeerCertificates[0]); got != pin {
+				return fmt.Errorf("server certificate %s does not match the pinned %s", got, pin)
+			}
+			return nil
+		}
+	default:
+		knownHosts, err := t.knownHosts()
+		if err != nil {
+			return nil, err
+		}
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return trustOnFirstUse(knownHosts, addr, Fingerprint(state.PeerCertificates[0]))
+		}
+	}
+	return config, nil
+}
+
+func (t *ClientTLS) knownHosts() (string, error) {
+	if t.KnownHosts != "" {
+		return t.KnownHosts, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("no known hosts file: %v", err)
+	}
+	return filepath.Join(home, ".nssds_known_hosts"), nil
+}
+
+// trustOnFirstUse accepts the certificate fingerprint of addr if it is
+// the one seen before, or, if addr is new, records it in the known hosts
+// file, which holds one "addr fingerprint" line per server.
+func trustOnFirstUse(knownHosts, addr, fingerprint string) error {
+	file, err := os.OpenFile(knownHosts, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening known hosts: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != addr {
+			continue
+		}
+		if fields[1] != fingerprint {
+			return fmt.Errorf("certificate of %s has changed to %s; if that is expected, remove its line from %s",
+				addr, fingerprint, knownHosts)
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading known hosts: %v", err)
+	}
+
+	if _, err := fmt.Fprintf(file, "%s %s\n", addr, fingerprint); err != nil {
+		return fmt.Errorf("error writing known hosts: %v", err)
+	}
+	fmt.Printf("trusting the certificate of %s on first use: %s\n", addr, fingerprint)
+	return nil
+}
+
+// Fingerprint returns the SHA-256 of cert in hex.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts the colon-separated, upper-case form that
+// openssl prints as well.
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimPrefix(strings.ToLower(fingerprint), "sha256:")
+	return strings.ReplaceAll(fingerprint, ":", "")
+}
+
+func loadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificates: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// GenerateCert writes a self-signed certificate for hosts, names or IP
+// addresses, and its key, and returns the certificate's fingerprint. The
+// certificate serves for both servers and clients, and since it is its
+// own CA, the file can be given as a client CA or a CA to trust as is.
+func GenerateCert(certFile, keyFile string, hosts []string, validFor time.Duration) (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("error generating key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", fmt.Errorf("error generating serial number: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"NSSDS labs"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", fmt.Errorf("error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("error encoding key: %v", err)
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return "", err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return "", err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", fmt.Errorf("error parsing certificate: %v", err)
+	}
+	return Fingerprint(cert), nil
+}
+
+func writePEM(file, blockType string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, perm); err != nil {
+		return fmt.Errorf("error writing %s: %v", file, err)
+	}
+	return nil
+}
@@ -2,45 +2,89 @@ package client
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"lab_2/udp"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	CommandQueueSize  = 16
+	TransferQueueSize = udp.WindowSize * 2
+)
+
+// Client talks to one server at a time. With Addr set it connects there
+// and exits when the session ends; otherwise it asks for an address each
+// time. CurrentDir is the working directory if empty, Timeout 5 seconds if
+// zero, and a ChunkSize in Options, if set, replaces the path MTU probe.
+// With User set, the client logs in as soon as it is connected, and with
+// Security set, it encrypts the session and refuses servers that cannot.
 type Client struct {
 	Conn       *net.UDPConn
+	Addr       string
 	ServerAddr *net.UDPAddr
+	Commands   *udp.Stream
 	CurrentDir string
 	Timeout    time.Duration
+	Options    udp.TransferOptions
+	User       string
+	Password   string
+	Security   *udp.Security
+	Server     udp.Hello           // what the server announced in its WELCOME
+	agreed     udp.TransferOptions // for the last transfer, and replies since
+	mux        *udp.Mux
+	chunkSize  int // the configured chunk size, or 0 to probe
+	requestID  uint32
+	serverDown atomic.Bool
+	serverGone atomic.Bool // the server said GOODBYE
 }
 
 func (c *Client) RunClient() {
-	c.CurrentDir, _ = os.Getwd()
-	c.Timeout = 5 * time.Second
+	c.CurrentDir, _ = filepath.Abs(c.CurrentDir)
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+	c.chunkSize = c.Options.ChunkSize
 
 	for {
-		if err := c.connectToServer(); err != nil {
+		err := c.connectToServer()
+		if err == nil && c.User != "" {
+			err = c.login()
+		}
+		if err != nil {
 			fmt.Printf("Connection error: %v\n", err)
+			if c.Addr != "" {
+				return
+			}
 			time.Sleep(2 * time.Second)
 			continue
 		}
 		if err := c.handleCommands(); err != nil {
 			fmt.Printf("Command error: %v\n", err)
 		}
+		if c.Addr != "" {
+			return
+		}
 	}
 }
 
 func (c *Client) connectToServer() error {
-	fmt.Print("Enter server address (default: 127.0.0.1:8000): ")
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	serverAddr := scanner.Text()
+	serverAddr := c.Addr
 	if serverAddr == "" {
-		serverAddr = "127.0.0.1:8000"
+		fmt.Print("Enter server address (default: 127.0.0.1:8000): ")
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Scan()
+		serverAddr = scanner.Text()
+		if serverAddr == "" {
+			serverAddr = "127.0.0.1:8000"
+		}
 	}
 
 	var err error
@@ -53,11 +97,95 @@ func (c *Client) connectToServer() error {
 	if err != nil {
 		return fmt.Errorf("error creating connection: %v", err)
 	}
+	c.mux = udp.NewMux(c.Conn, c.ServerAddr)
+	c.Commands = c.mux.Open(udp.CommandStream, CommandQueueSize)
+	c.mux.OnGoodbye = c.serverLeaving
+	c.serverGone.Store(false)
+	go c.mux.Serve()
+
+	c.Server, err = udp.Handshake(c.Commands, c.Timeout, c.Security)
+	if err != nil {
+		c.Conn.Close()
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+	c.serverDown.Store(false)
+	c.agreed = udp.TransferOptions{ReceiveTimeout: c.Options.ReceiveTimeout}
+	go c.watchServer(c.mux)
+
+	if c.chunkSize != 0 {
+		c.Options.ChunkSize = c.chunkSize
+		fmt.Printf("Connected to server at %s, protocol version %d%s (chunk size %d, configured)\n",
+			serverAddr, c.Server.Version, c.secured(), c.Options.ChunkSize)
+		return nil
+	}
+
+	mtu := udp.FallbackMTU
+	if c.Server.Supports("probe") {
+		mtu, err = udp.ProbePathMTU(c.Commands)
+		if err != nil {
+			fmt.Printf("Path MTU probe failed (%v), assuming %d\n", err, mtu)
+		}
+	}
+	c.Options.ChunkSize = udp.ChunkSizeForMTU(mtu, c.Commands)
 
-	fmt.Printf("Connected to server at %s\n", serverAddr)
+	fmt.Printf("Connected to server at %s, protocol version %d%s (path MTU %d, chunk size %d)\n",
+		serverAddr, c.Server.Version, c.secured(), mtu, c.Options.ChunkSize)
 	return nil
 }
 
+// secured notes an encrypted session.
+func (c *Client) secured() string {
+	if !c.Commands.Sealed() {
+		return ""
+	}
+	return ", encrypted"
+}
+
+// login logs in as User right after connecting.
+func (c *Client) login() error {
+	response, err := c.sendCommand("login " + c.User + " " + c.Password)
+	if err == nil && strings.HasPrefix(response, "error") {
+		err = errors.New(strings.TrimPrefix(response, "error: "))
+	}
+	if err != nil {
+		c.Conn.Close()
+		return fmt.Errorf("login failed: %v", err)
+	}
+	fmt.Println(response)
+	return nil
+}
+
+// watchServer sends heartbeats while the connection is open and reports
+// when the server has gone quiet for DeadPeerTimeout, and when it is heard
+// from again.
+func (c *Client) watchServer(mux *udp.Mux) {
+	ticker := time.NewTicker(udp.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := mux.Heartbeat(); errors.Is(err, net.ErrClosed) {
+			return
+		}
+
+		silent := time.Since(mux.LastHeard())
+		if silent > udp.DeadPeerTimeout {
+			if !c.serverDown.Swap(true) {
+				fmt.Printf("\nServer %s is not responding (silent for %s)\n", mux.Addr, silent.Round(time.Second))
+			}
+		} else if c.serverDown.Swap(false) {
+			fmt.Printf("\nServer %s is responding again\n", mux.Addr)
+		}
+	}
+}
+
+// serverLeaving reports the server's GOODBYE. A running transfer is left to
+// finish, as the server lets it; the next command goes back to connecting.
+func (c *Client) serverLeaving(reason string) {
+	if !c.serverGone.Swap(true) {
+		fmt.Printf("\nServer %s is going away: %s\n", c.ServerAddr, reason)
+	}
+}
+
 func (c *Client) handleCommands() error {
 	defer c.Conn.Close()
 	scanner := bufio.NewScanner(os.Stdin)
@@ -73,6 +201,15 @@ func (c *Client) handleCommands() error {
 			continue
 		}
 
+		// Rather than wait out every retry, give up on a server that has
+		// stopped answering heartbeats and go back to connecting.
+		if c.serverDown.Load() {
+			return fmt.Errorf("server %s is not responding", c.ServerAddr)
+		}
+		if c.serverGone.Load() {
+			return fmt.Errorf("server %s has shut down", c.ServerAddr)
+		}
+
 		response, err := c.executeCommand(parts)
 		if err != nil {
 			return err
@@ -91,6 +228,11 @@ func (c *Client) executeCommand(parts []string) (string, error) {
 	args := parts[1:]
 
 	switch cmd {
+	case "login":
+		if len(args) != 2 {
+			return "error: usage: login <name> <password>", nil
+		}
+		return c.sendCommand("login " + args[0] + " " + args[1])
 	case "echo":
 		return c.sendCommand("echo " + strings.Join(args, " "))
 	case "time":
@@ -104,17 +246,115 @@ func (c *Client) executeCommand(parts []string) (string, error) {
 			return "error: path required", nil
 		}
 		return c.sendCommand("cd " + args[0])
+	case "pwd", "mkdir", "rm", "rmdir", "mv", "rename", "cp", "stat":
+		return c.sendCommand(strings.Join(append([]string{cmd}, args...), " "))
 	case "download":
 		return c.handleDownload(args...)
 	case "upload":
 		return c.handleUpload(args...)
+	case "fec":
+		return c.setFEC(args...)
+	case "chunk":
+		return c.setChunkSize(args...)
 	default:
 		return "error: unknown command", nil
 	}
 }
 
 func (c *Client) sendCommand(cmd string) (string, error) {
-	return udp.SendCommandWithResponse(c.Conn, c.ServerAddr, cmd, c.Timeout)
+	stream, response, err := c.request(cmd)
+	c.release(stream)
+	return response, err
+}
+
+// request sends cmd under a fresh request ID, so a retry is recognised by
+// the server and a late reply to an earlier command is not taken for this
+// one's. The stream of the same ID is opened first: it carries replies too
+// large for one datagram and the transfer an upload or download starts.
+func (c *Client) request(cmd string) (*udp.Stream, string, error) {
+	c.requestID++
+	stream := c.mux.Open(c.requestID, TransferQueueSize)
+	response, err := udp.SendCommandWithResponse(c.Commands, stream, c.requestID, cmd, c.Timeout, c.agreed)
+	return stream, response, err
+}
+
+// release closes a request's stream once the server has stopped
+// retransmitting on it.
+func (c *Client) release(stream *udp.Stream) {
+	go func() {
+		udp.Linger(stream)
+		c.mux.Close(stream.ID)
+	}()
+}
+
+// setFEC sets how many data packets each parity packet covers in later
+// transfers; 0 turns forward error correction off.
+func (c *Client) setFEC(args ...string) (string, error) {
+	if len(args) == 0 {
+		return fmt.Sprintf("fec block is %d", c.Options.FECBlock), nil
+	}
+	options, err := udp.ParseTransferOptions([]string{"fec=" + args[0]})
+	if err != nil {
+		return fmt.Sprintf("error: %v", err), nil
+	}
+	c.Options.FECBlock = options.FECBlock
+	if c.Options.FECBlock == 0 {
+		return "fec disabled", nil
+	}
+	return fmt.Sprintf("fec enabled: one parity packet per %d data packets", c.Options.FECBlock), nil
+}
+
+// setChunkSize overrides the chunk size found by the path MTU probe.
+func (c *Client) setChunkSize(args ...string) (string, error) {
+	if len(args) == 0 {
+		return fmt.Sprintf("chunk size is %d", c.Options.ChunkSize), nil
+	}
+	options, err := udp.ParseTransferOptions([]string{"chunk=" + args[0]})
+	if err != nil {
+		return fmt.Sprintf("error: %v", err), nil
+	}
+	c.Options.ChunkSize = options.ChunkSize
+	return fmt.Sprintf("chunk size set to %d", c.Options.ChunkSize), nil
+}
+
+// transferCommand proposes the client's transfer options along with the
+// command, leaving out those the server did not announce support for.
+func (c *Client) transferCommand(cmd, fileName string) string {
+	options := c.Options
+	if !c.Server.Supports("fec") {
+		options.FECBlock = 0
+	}
+	if !c.Server.Supports("chunk") {
+		options.ChunkSize = 0
+	}
+	return strings.TrimSpace(cmd + " " + fileName + " " + options.String())
+}
+
+// openTransfer checks the server's "ready <id> [options]" reply names the
+// request's stream and returns the options the server agreed to, which
+// its large replies use from now on.
+func (c *Client) openTransfer(stream *udp.Stream, response string) (udp.TransferOptions, error) {
+	fields := strings.Fields(response)
+	if len(fields) < 2 || fields[0] != "ready" || fields[1] != strconv.FormatUint(uint64(stream.ID), 10) {
+		return udp.TransferOptions{}, fmt.Errorf("server not ready: %s", response)
+	}
+	options, err := udp.ParseTransferOptions(fields[2:])
+	if err != nil {
+		return udp.TransferOptions{}, fmt.Errorf("bad transfer options from server: %v", err)
+	}
+	options.ReceiveTimeout = c.Options.ReceiveTimeout
+	c.agreed = options
+	return options, nil
+}
+
+// waitCompletion reads the transfer outcome the server sends on the
+// command channel for the transfer command cmd, the last request sent.
+func (c *Client) waitCompletion(cmd string) (string, error) {
+	completion, err := udp.AwaitNotification(c.Commands, c.requestID, cmd, c.Timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to get completion: %v", err)
+	}
+	return completion, nil
 }
 
 func (c *Client) handleUpload(args ...string) (string, error) {
@@ -122,30 +362,33 @@ func (c *Client) handleUpload(args ...string) (string, error) {
 		return "error: file name required", nil
 	}
 
-	response, err := c.sendCommand("upload " + args[0])
+	command := c.transferCommand("upload", args[0])
+	stream, response, err := c.request(command)
 	if err != nil {
+		c.mux.Close(stream.ID)
 		return "", fmt.Errorf("upload command failed: %v", err)
 	}
 
-	if response != "ready" {
-		return "", fmt.Errorf("server not ready: %s", response)
+	options, err := c.openTransfer(stream, response)
+	if err != nil {
+		c.mux.Close(stream.ID)
+		return "", err
 	}
 
 	filePath := filepath.Join(c.CurrentDir, args[0])
-	if err := udp.Upload(filePath, c.Conn, c.ServerAddr); err != nil {
+	err = udp.Upload(filePath, stream, options)
+	c.mux.Close(stream.ID)
+	if err != nil {
 		return "", fmt.Errorf("upload failed: %v", err)
 	}
 
-	// Wait for completion
-	c.Conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-	buf := make([]byte, 1024)
-	n, _, err := c.Conn.ReadFromUDP(buf)
+	completion, err := c.waitCompletion(command)
 	if err != nil {
-		return "", fmt.Errorf("failed to get completion: %v", err)
+		return "", err
 	}
 
-	if string(buf[:n]) != "upload complete" {
-		return "", fmt.Errorf("upload failed: %s", string(buf[:n]))
+	if completion != "upload complete" {
+		return "", fmt.Errorf("upload failed: %s", completion)
 	}
 
 	return "file uploaded successfully", nil
@@ -156,35 +399,43 @@ func (c *Client) handleDownload(args ...string) (string, error) {
 		return "error: file name required", nil
 	}
 
-	response, err := c.sendCommand("download " + args[0])
+	command := c.transferCommand("download", args[0])
+	stream, response, err := c.request(command)
 	if err != nil {
+		c.mux.Close(stream.ID)
 		return "", fmt.Errorf("download command failed: %v", err)
 	}
 
-	if response != "ready" {
-		return "", fmt.Errorf("server not ready: %s", response)
+	options, err := c.openTransfer(stream, response)
+	if err != nil {
+		c.mux.Close(stream.ID)
+		return "", err
 	}
 
-	localFile := args[0]
+	localFile := path.Base(args[0])
 	if len(args) > 1 {
 		localFile = args[1]
 	}
 
 	filePath := filepath.Join(c.CurrentDir, localFile)
-	if err := udp.Download(filePath, c.Conn, c.ServerAddr); err != nil {
+	file, err := os.Create(filePath)
+	if err != nil {
+		c.mux.Close(stream.ID)
+		return "", fmt.Errorf("error creating file: %v", err)
+	}
+	if err := udp.Download(file, stream, options); err != nil {
+		c.mux.Close(stream.ID)
 		return "", fmt.Errorf("download failed: %v", err)
 	}
+	c.release(stream)
 
-	// Wait for completion
-	c.Conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-	buf := make([]byte, 1024)
-	n, _, err := c.Conn.ReadFromUDP(buf)
+	completion, err := c.waitCompletion(command)
 	if err != nil {
-		return "", fmt.Errorf("failed to get completion: %v", err)
+		return "", err
 	}
 
-	if string(buf[:n]) != "download complete" {
-		return "", fmt.Errorf("download failed: %s", string(buf[:n]))
+	if completion != "download complete" {
+		return "", fmt.Errorf("download failed: %s", completion)
 	}
 
 	return fmt.Sprintf("file downloaded successfully to %s", filePath), nil
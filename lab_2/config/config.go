@@ -0,0 +1,191 @@
+// Package config holds the settings of the server and the client. They
+// come from built-in defaults, an optional JSON file and NSSDS_*
+// environment variables, each overriding the one before; command-line
+// flags, applied by main, override them all.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"lab_2/udp"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// EnvFile names the config file when no -config flag is given.
+const EnvFile = "NSSDS_CONFIG"
+
+type Config struct {
+	Server Server `json:"server"`
+	Client Client `json:"client"`
+	// AckTimeout is the initial retransmission timeout of both sides.
+	AckTimeout Duration `json:"ack_timeout" env:"NSSDS_ACK_TIMEOUT"`
+	// ReceiveTimeout is how long either side, receiving a file, waits for
+	// its next packet.
+	ReceiveTimeout Duration `json:"receive_timeout" env:"NSSDS_RECEIVE_TIMEOUT"`
+}
+
+type Server struct {
+	Listen       string   `json:"listen" env:"NSSDS_LISTEN"`
+	Root         string   `json:"root" env:"NSSDS_ROOT"`
+	DrainTimeout Duration `json:"drain_timeout" env:"NSSDS_DRAIN_TIMEOUT"`
+	// Users is the users file (see package auth). Without one, clients
+	// need no login and may read and write everything under Root.
+	Users string `json:"users" env:"NSSDS_USERS"`
+	// Key is the server's static key file, written by genkey. With one,
+	// every session must be encrypted.
+	Key string `json:"key" env:"NSSDS_KEY"`
+	// PSK, if set, is a secret a client must also know to get a session.
+	PSK string `json:"psk" env:"NSSDS_PSK"`
+}
+
+type Client struct {
+	// Addr is the server to connect to. If it is empty, the client asks.
+	Addr string `json:"addr" env:"NSSDS_ADDR"`
+	Dir  string `json:"dir" env:"NSSDS_DIR"`
+	// Timeout is how long a command waits for each reply.
+	Timeout Duration `json:"timeout" env:"NSSDS_TIMEOUT"`
+	// ChunkSize overrides the path MTU probe if it is not 0.
+	ChunkSize int `json:"chunk_size" env:"NSSDS_CHUNK_SIZE"`
+	// FECBlock is the data packets per parity packet; 0 disables FEC.
+	FECBlock int `json:"fec_block" env:"NSSDS_FEC_BLOCK"`
+	// User and Password, if set, log the client in on connecting. The
+	// password is better kept in the environment than in the file.
+	User     string `json:"user" env:"NSSDS_USER"`
+	Password string `json:"password" env:"NSSDS_PASSWORD"`
+	// Secure encrypts the session. The server's key is checked against
+	// ServerKey if set, and otherwise trusted on first use and remembered
+	// in KnownHosts (~/.nssds_udp_known_hosts if empty).
+	Secure     bool   `json:"secure" env:"NSSDS_SECURE"`
+	ServerKey  string `json:"server_key" env:"NSSDS_SERVER_KEY"`
+	PSK        string `json:"psk" env:"NSSDS_PSK"`
+	KnownHosts string `json:"known_hosts" env:"NSSDS_KNOWN_HOSTS"`
+}
+
+// UsesEncryption reports whether the client encrypts its session.
+func (c Client) UsesEncryption() bool {
+	return c.Secure || c.ServerKey != "" || c.PSK != ""
+}
+
+func Default() Config {
+	return Config{
+		Server: Server{
+			Listen:       ":8000",
+			Root:         ".",
+			DrainTimeout: Duration(30 * time.Second),
+		},
+		Client: Client{
+			Dir:     ".",
+			Timeout: Duration(5 * time.Second),
+		},
+		AckTimeout:     Duration(2 * time.Second),
+		ReceiveTimeout: Duration(udp.ReceiveTimeout),
+	}
+}
+
+// Load returns the defaults overridden by the file at path, if path is not
+// empty, and then by the environment.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("error reading config: %v", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("error parsing config %s: %v", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem()); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the settings that cannot be fixed up with a default.
+func (c Config) Validate() error {
+	if c.AckTimeout <= 0 {
+		return fmt.Errorf("ack_timeout must be positive")
+	}
+	if c.ReceiveTimeout <= 0 {
+		return fmt.Errorf("receive_timeout must be positive")
+	}
+	if c.Client.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	options := []string{fmt.Sprintf("fec=%d", c.Client.FECBlock)}
+	if c.Client.ChunkSize != 0 {
+		options = append(options, fmt.Sprintf("chunk=%d", c.Client.ChunkSize))
+	}
+	if c.Server.PSK != "" && c.Server.Key == "" {
+		return fmt.Errorf("psk needs a server key")
+	}
+	_, err := udp.ParseTransferOptions(options)
+	return err
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// applyEnv sets every field tagged with env whose variable is set.
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, info := v.Field(i), v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+		name := info.Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+
+		switch {
+		case field.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.SetInt(int64(n))
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		}
+	}
+	return nil
+}
+
+// Duration is a time.Duration written as a string such as "30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -1,3 +1,7 @@
 module lab_2
 
 go 1.24
+
+require golang.org/x/crypto v0.22.0
+
+require golang.org/x/sys v0.19.0 // indirect
@@ -1,29 +1,183 @@
 package main
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
+	"lab_2/auth"
 	"lab_2/client"
+	"lab_2/config"
 	"lab_2/server"
+	"lab_2/udp"
 	"os"
+	"strings"
+	"time"
 )
 
+const usage = `usage:
+  lab_2 serve [flags]            run the server (alias -s)
+  lab_2 connect [flags] [addr]   run the client (alias -c)
+  lab_2 adduser [flags] name     add a user to the users file, or change
+                                 one; the password is read from stdin
+  lab_2 genkey [-key file]       write a static key for encrypted sessions
+                                 (default server.key)
+
+Settings come from defaults, then the JSON file given by -config or $%s,
+then NSSDS_* environment variables, then flags. Run a command with -h for
+its flags.
+`
+
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("use flag -c for running client or -s for running server")
+		fmt.Printf(usage, config.EnvFile)
 		os.Exit(1)
 	}
 
 	mode := os.Args[1]
 	switch mode {
-	case "-s":
-		s := new(server.Server)
+	case "serve", "-s":
+		flags, cfg := loadConfig("serve", os.Args[2:], func(flags *flag.FlagSet, cfg *config.Config) {
+			flags.StringVar(&cfg.Server.Listen, "listen", cfg.Server.Listen, "address to listen on")
+			flags.StringVar(&cfg.Server.Root, "root", cfg.Server.Root, "directory to serve")
+			flags.DurationVar((*time.Duration)(&cfg.Server.DrainTimeout), "drain-timeout", time.Duration(cfg.Server.DrainTimeout), "how long a shutdown waits for running transfers")
+			flags.StringVar(&cfg.Server.Users, "users", cfg.Server.Users, "users file; without one no login is required")
+			flags.StringVar(&cfg.Server.Key, "key", cfg.Server.Key, "static key file; with one, sessions must be encrypted")
+			flags.StringVar(&cfg.Server.PSK, "psk", cfg.Server.PSK, "pre-shared key clients must also know")
+		})
+		if flags.NArg() > 0 {
+			fmt.Printf("unexpected argument: %s\n", flags.Arg(0))
+			os.Exit(1)
+		}
+		server.DrainTimeout = time.Duration(cfg.Server.DrainTimeout)
+		s := &server.Server{
+			ListenAddr:     cfg.Server.Listen,
+			Root:           cfg.Server.Root,
+			ReceiveTimeout: time.Duration(cfg.ReceiveTimeout),
+		}
+		if cfg.Server.Users != "" {
+			users, err := auth.Load(cfg.Server.Users)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			s.Users = users
+		}
+		if cfg.Server.Key != "" {
+			key, err := udp.LoadKey(cfg.Server.Key)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			s.Key, s.PSK = key, cfg.Server.PSK
+		}
 		s.RunServer()
-	case "-c":
-		c := new(client.Client)
+	case "connect", "-c":
+		flags, cfg := loadConfig("connect", os.Args[2:], func(flags *flag.FlagSet, cfg *config.Config) {
+			flags.StringVar(&cfg.Client.Dir, "dir", cfg.Client.Dir, "local directory for uploads and downloads")
+			flags.DurationVar((*time.Duration)(&cfg.Client.Timeout), "timeout", time.Duration(cfg.Client.Timeout), "how long a command waits for each reply")
+			flags.IntVar(&cfg.Client.ChunkSize, "chunk-size", cfg.Client.ChunkSize, "file data per packet; 0 probes the path MTU")
+			flags.IntVar(&cfg.Client.FECBlock, "fec", cfg.Client.FECBlock, "data packets per parity packet; 0 disables FEC")
+			flags.StringVar(&cfg.Client.User, "user", cfg.Client.User, "log in as this user, with the password from $NSSDS_PASSWORD or the config")
+			flags.BoolVar(&cfg.Client.Secure, "secure", cfg.Client.Secure, "encrypt the session, trusting the server's key on first use")
+			flags.StringVar(&cfg.Client.ServerKey, "server-key", cfg.Client.ServerKey, "accept only the server with this key")
+			flags.StringVar(&cfg.Client.PSK, "psk", cfg.Client.PSK, "pre-shared key the server requires")
+			flags.StringVar(&cfg.Client.KnownHosts, "known-hosts", cfg.Client.KnownHosts, "server keys trusted on first use (default ~/.nssds_udp_known_hosts)")
+		})
+		if flags.NArg() > 0 {
+			cfg.Client.Addr = flags.Arg(0)
+		}
+		c := &client.Client{
+			Addr:       cfg.Client.Addr,
+			CurrentDir: cfg.Client.Dir,
+			Timeout:    time.Duration(cfg.Client.Timeout),
+			Options: udp.TransferOptions{
+				FECBlock:       cfg.Client.FECBlock,
+				ChunkSize:      cfg.Client.ChunkSize,
+				ReceiveTimeout: time.Duration(cfg.ReceiveTimeout),
+			},
+			User:     cfg.Client.User,
+			Password: cfg.Client.Password,
+		}
+		if cfg.Client.UsesEncryption() {
+			c.Security = &udp.Security{
+				Trust: udp.ServerTrust{Pin: cfg.Client.ServerKey, KnownHosts: cfg.Client.KnownHosts},
+				PSK:   cfg.Client.PSK,
+			}
+		}
 		c.RunClient()
+	case "adduser":
+		role, home := string(auth.ReadWrite), ""
+		flags, cfg := loadConfig("adduser", os.Args[2:], func(flags *flag.FlagSet, cfg *config.Config) {
+			flags.StringVar(&cfg.Server.Users, "users", cfg.Server.Users, "users file")
+			flags.StringVar(&role, "role", role, "ro for read-only, rw for read-write")
+			flags.StringVar(&home, "home", home, "home directory under the server root (default /<name>)")
+		})
+		if flags.NArg() != 1 || cfg.Server.Users == "" {
+			fmt.Println("usage: adduser -users FILE [-role ro|rw] [-home DIR] name")
+			os.Exit(1)
+		}
+		name := flags.Arg(0)
+		if home == "" {
+			home = "/" + name
+		}
+		fmt.Print("Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			fmt.Printf("\nerror: no password given (%v)\n", err)
+			os.Exit(1)
+		}
+		if err := auth.AddUser(cfg.Server.Users, name, password, auth.Role(role), home); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("user %s saved to %s\n", name, cfg.Server.Users)
+	case "genkey":
+		keyFile := "server.key"
+		flags := flag.NewFlagSet("genkey", flag.ExitOnError)
+		flags.StringVar(&keyFile, "key", keyFile, "key file to write")
+		_ = flags.Parse(os.Args[2:])
+		public, err := udp.GenerateKey(keyFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("key written to %s\n", keyFile)
+		fmt.Printf("public key (for -server-key): %s\n", public)
+	case "-h", "-help", "--help", "help":
+		fmt.Printf(usage, config.EnvFile)
 	default:
-		fmt.Printf("unknown argument: %s\n", mode)
+		fmt.Printf("unknown command: %s\n", mode)
+		fmt.Printf(usage, config.EnvFile)
+		os.Exit(1)
+	}
+
+}
+
+// loadConfig builds the settings of a command. define binds the command's
+// own flags to cfg. The flags are parsed twice: first to find -config, then
+// again over the loaded config so that they take precedence over it.
+func loadConfig(name string, args []string, define func(*flag.FlagSet, *config.Config)) (*flag.FlagSet, config.Config) {
+	cfg := config.Default()
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	path := flags.String("config", os.Getenv(config.EnvFile), "JSON config file")
+	flags.DurationVar((*time.Duration)(&cfg.AckTimeout), "ack-timeout", time.Duration(cfg.AckTimeout), "initial retransmission timeout")
+	flags.DurationVar((*time.Duration)(&cfg.ReceiveTimeout), "receive-timeout", time.Duration(cfg.ReceiveTimeout), "how long a file transfer waits for its next packet")
+	define(flags, &cfg)
+	_ = flags.Parse(args)
+
+	loaded, err := config.Load(*path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cfg = loaded
+	_ = flags.Parse(args)
+	if err := cfg.Validate(); err != nil {
+		fmt.Printf("error in config: %v\n", err)
 		os.Exit(1)
 	}
 
+	udp.SetAckTimeout(time.Duration(cfg.AckTimeout))
+	return flags, cfg
 }
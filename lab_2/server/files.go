@@ -0,0 +1,285 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The file management commands. Paths are resolved in the client's jail
+// like those of ls and cd; the entry a path names is not followed if it is
+// a symlink, so rm, mv and stat act on the link itself. Errors name the
+// virtual paths only.
+
+func handlePwd(currentDir string) string {
+	return currentDir
+}
+
+// handleMkdir runs "mkdir [-p] <dir>"; with -p, missing parents are
+// created as well and an existing directory is not an error.
+func handleMkdir(jail *Jail, currentDir string, args ...string) string {
+	parents, args, err := options(args, "p")
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if len(args) != 1 {
+		return "error: usage: mkdir [-p] <dir>"
+	}
+	realPath, virtual, err := jail.Resolve(currentDir, args[0])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if parents["p"] {
+		err = os.MkdirAll(realPath, 0755)
+	} else {
+		err = os.Mkdir(realPath, 0755)
+	}
+	if err != nil {
+		return jail.Hide(fmt.Sprintf("error: %v", err))
+	}
+	return fmt.Sprintf("created directory %s", virtual)
+}
+
+// handleRm runs "rm [-r] <path>"; a directory needs -r, and then goes
+// with everything in it.
+func handleRm(jail *Jail, currentDir string, args ...string) string {
+	recursive, args, err := options(args, "r")
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if len(args) != 1 {
+		return "error: usage: rm [-r] <path>"
+	}
+	realPath, virtual, info, err := jail.existing(currentDir, args[0])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if virtual == "/" {
+		return "error: cannot remove /"
+	}
+	if info.IsDir() && !recursive["r"] {
+		return fmt.Sprintf("error: %s is a directory, use rm -r", virtual)
+	}
+	if err := os.RemoveAll(realPath); err != nil {
+		return jail.Hide(fmt.Sprintf("error: %v", err))
+	}
+	return fmt.Sprintf("removed %s", virtual)
+}
+
+// handleRmdir runs "rmdir <dir>", which must be empty.
+func handleRmdir(jail *Jail, currentDir string, args ...string) string {
+	if len(args) != 1 {
+		return "error: usage: rmdir <dir>"
+	}
+	realPath, virtual, info, err := jail.existing(currentDir, args[0])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if virtual == "/" {
+		return "error: cannot remove /"
+	}
+	if !info.IsDir() {
+		return fmt.Sprintf("error: %s is not a directory", virtual)
+	}
+	if err := os.Remove(realPath); err != nil {
+		return jail.Hide(fmt.Sprintf("error: %v", err))
+	}
+	return fmt.Sprintf("removed directory %s", virtual)
+}
+
+// handleMv runs "mv <from> <to>". If to is a directory, from is moved into
+// it; an existing file at to is replaced.
+func handleMv(jail *Jail, currentDir string, args ...string) string {
+	if len(args) != 2 {
+		return "error: usage: mv <from> <to>"
+	}
+	from, fromVirtual, _, err := jail.existing(currentDir, args[0])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if fromVirtual == "/" {
+		return "error: cannot move /"
+	}
+	to, toVirtual, err := jail.target(currentDir, args[1], path.Base(fromVirtual))
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if within(to, from) {
+		return fmt.Sprintf("error: cannot move %s into itself", fromVirtual)
+	}
+	if err := os.Rename(from, to); err != nil {
+		return jail.Hide(fmt.Sprintf("error: %v", err))
+	}
+	return fmt.Sprintf("moved %s to %s", fromVirtual, toVirtual)
+}
+
+// handleCp runs "cp [-r] <from> <to>". If to is a directory, from is
+// copied into it. A directory needs -r; symlinks inside it are copied as
+// links rather than followed. Nothing is written through a symlink at the
+// destination, as it could lead out of the jail.
+func handleCp(jail *Jail, currentDir string, args ...string) string {
+	recursive, args, err := options(args, "r")
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if len(args) != 2 {
+		return "error: usage: cp [-r] <from> <to>"
+	}
+	from, fromVirtual, err := jail.Resolve(currentDir, args[0])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	info, err := os.Stat(from)
+	if err != nil {
+		return fmt.Sprintf("error: %s does not exist", fromVirtual)
+	}
+	if info.IsDir() && !recursive["r"] {
+		return fmt.Sprintf("error: %s is a directory, use cp -r", fromVirtual)
+	}
+	to, toVirtual, err := jail.target(currentDir, args[1], path.Base(fromVirtual))
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if within(to, from) {
+		return fmt.Sprintf("error: cannot copy %s into itself", fromVirtual)
+	}
+	if toInfo, err := os.Lstat(to); err == nil && toInfo.Mode()&fs.ModeSymlink != 0 {
+		return fmt.Sprintf("error: %s is a symlink", toVirtual)
+	}
+
+	if info.IsDir() {
+		err = copyTree(from, to)
+	} else {
+		err = copyFile(from, to, info.Mode().Perm())
+	}
+	if err != nil {
+		return jail.Hide(fmt.Sprintf("error: %v", err))
+	}
+	return fmt.Sprintf("copied %s to %s", fromVirtual, toVirtual)
+}
+
+// handleStat runs "stat <path>", reporting its type, size, mode,
+// modification time and owner.
+func handleStat(jail *Jail, currentDir string, args ...string) string {
+	if len(args) != 1 {
+		return "error: usage: stat <path>"
+	}
+	_, virtual, info, err := jail.existing(currentDir, args[0])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+
+	fileType := "file"
+	switch {
+	case info.IsDir():
+		fileType = "directory"
+	case info.Mode()&fs.ModeSymlink != 0:
+		fileType = "symlink"
+	case !info.Mode().IsRegular():
+		fileType = "special file"
+	}
+	fields := []string{
+		fileType,
+		fmt.Sprintf("%d bytes", info.Size()),
+		fmt.Sprintf("mode %s (%04o)", info.Mode(), info.Mode().Perm()),
+		fmt.Sprintf("modified %s", info.ModTime().Format("2006-01-02 15:04:05 MST")),
+	}
+	if owner := fileOwner(info); owner != "" {
+		fields = append(fields, "owner "+owner)
+	}
+	return fmt.Sprintf("%s: %s", virtual, strings.Join(fields, ", "))
+}
+
+// within reports whether the real path name is dir or inside it.
+func within(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, dir+string(filepath.Separator))
+}
+
+// options takes the leading "-x" flags off args, allowing only those in
+// allowed.
+func options(args []string, allowed string) (map[string]bool, []string, error) {
+	set := make(map[string]bool)
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, flag := range args[0][1:] {
+			if !strings.ContainsRune(allowed, flag) {
+				return nil, nil, fmt.Errorf("unknown option -%c", flag)
+			}
+			set[string(flag)] = true
+		}
+		args = args[1:]
+	}
+	return set, args, nil
+}
+
+// copyFile copies the file from to to, which is replaced if it is a file
+// but not followed if it is a symlink.
+func copyFile(from, to string, perm os.FileMode) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|noFollow, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// copyTree copies the directory from to to. The walk visits a directory
+// before what is in it, so each directory of the copy is made, or found
+// to be a real directory, before anything is written into it.
+func copyTree(from, to string) error {
+	return filepath.WalkDir(from, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, name)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(to, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			return makeDir(dst, info.Mode().Perm()|0700)
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, dst)
+		case entry.Type().IsRegular():
+			return copyFile(name, dst, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// makeDir creates the directory name, whose parent must exist, or accepts
+// one already there. A symlink there is refused, even one to a directory.
+func makeDir(name string, perm os.FileMode) error {
+	err := os.Mkdir(name, perm)
+	if !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s exists and is not a directory", name)
+	}
+	return nil
+}
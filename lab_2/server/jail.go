@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideRoot is returned for paths that lead out of the jail, which
+// only a symlink can do: ".." stops at the virtual root.
+var ErrOutsideRoot = errors.New("path leads outside the server root")
+
+// Jail confines client paths to Root. Clients see Root as "/" and keep
+// their working directory as a slash-separated path under it; Resolve maps
+// the paths they send onto the real file system.
+type Jail struct {
+	Root string
+}
+
+// NewJail returns a jail for dir, made absolute with its symlinks resolved
+// so that resolved paths can be compared against it.
+func NewJail(dir string) (*Jail, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error getting root directory: %v", err)
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving root directory: %v", err)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("root %s is not a directory", root)
+	}
+	return &Jail{Root: root}, nil
+}
+
+// Resolve maps name, absolute or relative to the virtual directory cwd, to
+// its virtual path and the real one. Symlinks along the part of the path
+// that exists are followed and must not leave Root; the rest, such as the
+// name of a file about to be uploaded, is taken as it is.
+func (j *Jail) Resolve(cwd, name string) (real, virtual string, err error) {
+	virtual = virtualPath(cwd, name)
+	existing := filepath.Join(j.Root, filepath.FromSlash(virtual))
+	var missing []string
+	for {
+		if _, err := os.Lstat(existing); err == nil || !os.IsNotExist(err) {
+			break
+		}
+		missing = append([]string{filepath.Base(existing)}, missing...)
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", virtual, fmt.Errorf("cannot resolve %s", virtual)
+	}
+	if !j.contains(resolved) {
+		return "", virtual, ErrOutsideRoot
+	}
+	return filepath.Join(append([]string{resolved}, missing...)...), virtual, nil
+}
+
+// virtualPath makes name, absolute or relative to the virtual directory
+// cwd, a clean virtual path.
+func virtualPath(cwd, name string) string {
+	if strings.HasPrefix(filepath.ToSlash(name), "/") {
+		return path.Clean(filepath.ToSlash(name))
+	}
+	return path.Join("/", cwd, filepath.ToSlash(name))
+}
+
+// Home returns a jail rooted at the directory dir of this one, creating it
+// if it does not exist yet.
+func (j *Jail) Home(dir string) (*Jail, error) {
+	real, virtual, err := j.Resolve("/", dir)
+	if err != nil {
+		return nil, err
+	}
+	if virtual == "/" {
+		return j, nil
+	}
+	if err := os.MkdirAll(real, 0755); err != nil {
+		return nil, err
+	}
+	return NewJail(real)
+}
+
+// existing resolves name to an entry that exists, without following it
+// if it is a symlink.
+func (j *Jail) existing(cwd, name string) (string, string, os.FileInfo, error) {
+	realPath, virtual, err := j.entry(cwd, name)
+	if err != nil {
+		return "", virtual, nil, err
+	}
+	info, err := os.Lstat(realPath)
+	if err != nil {
+		return "", virtual, nil, fmt.Errorf("%s does not exist", virtual)
+	}
+	return realPath, virtual, info, nil
+}
+
+// entry resolves name like Resolve, except that the last element of the
+// path is not followed if it is a symlink.
+func (j *Jail) entry(cwd, name string) (string, string, error) {
+	virtual := virtualPath(cwd, name)
+	if virtual == "/" {
+		return j.Root, virtual, nil
+	}
+	dir, _, err := j.Resolve("/", path.Dir(virtual))
+	if err != nil {
+		return "", virtual, err
+	}
+	return filepath.Join(dir, path.Base(virtual)), virtual, nil
+}
+
+// target resolves the destination of mv or cp: name itself, or the entry
+// base inside it if name is a directory.
+func (j *Jail) target(cwd, name, base string) (string, string, error) {
+	realPath, virtual, err := j.Resolve(cwd, name)
+	if err != nil {
+		return "", virtual, err
+	}
+	if info, err := os.Stat(realPath); err == nil && info.IsDir() {
+		return j.entry(virtual, base)
+	}
+	return j.entry(cwd, name)
+}
+
+// Hide replaces real paths in msg, such as those in file system errors,
+// with the virtual paths the client knows.
+func (j *Jail) Hide(msg string) string {
+	if j.Root == string(filepath.Separator) {
+		return msg
+	}
+	return strings.ReplaceAll(msg, j.Root, "")
+}
+
+func (j *Jail) contains(real string) bool {
+	rel, err := filepath.Rel(j.Root, real)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
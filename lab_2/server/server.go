@@ -1,25 +1,93 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
 	"fmt"
+	"lab_2/auth"
 	"lab_2/udp"
 	"net"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+const (
+	CommandQueueSize  = 16
+	TransferQueueSize = udp.WindowSize * 2
+	ResponseCacheSize = 64
+	ShutdownReason    = "server shutting down"
+)
+
+// DrainTimeout is how long a shutdown lets running transfers finish before
+// cutting them off.
+var DrainTimeout = 30 * time.Second
+
+// Server serves every client on one socket. It listens on ListenAddr, all
+// interfaces and udp.Port if empty, and serves Root, the working directory
+// if empty; clients see Root as "/" and cannot leave it. With Users set,
+// clients must log in, and then see only their home directory. With Key
+// set, every session must be encrypted, and with PSK set as well, only
+// clients that know it get one. While it shuts down, Draining is set:
+// running transfers go on, but new sessions and commands are refused.
 type Server struct {
 	Conn       *net.UDPConn
-	ClientAddr *net.UDPAddr
+	ListenAddr string
+	Root       string
+	Users      *auth.Users
+	Key        *ecdh.PrivateKey
+	PSK        string
+	// ReceiveTimeout is how long an upload waits for its next packet; 0
+	// means udp.ReceiveTimeout.
+	ReceiveTimeout time.Duration
+	jail           *Jail
+	Sessions       map[string]*Session
+	Draining       atomic.Bool
+	transfers      sync.WaitGroup
+	mu             sync.Mutex
+}
+
+// Session is the server side of one client address: its own working
+// directory under the virtual root, which is its home once it has logged
+// in, its command channel and the transfers it has running. The
+// read loop in handleRequests routes every datagram to its session by
+// address, and the session's mux routes it on by transfer ID.
+type Session struct {
+	Addr       *net.UDPAddr
 	CurrentDir string
+	jail       *Jail
+	user       *auth.User
+	failures   int        // failed logins
+	hello      []byte     // the HELLO that keyed the session
+	welcomed   udp.Packet // and the WELCOME it was answered with
+	Commands   *udp.Stream
+	mux        *udp.Mux
+	options    udp.TransferOptions // agreed for the last transfer
+	responses  map[uint32]udp.Packet
+	order      []uint32
+	transfers  *sync.WaitGroup
+	mu         sync.Mutex
 }
 
 func (s *Server) RunServer() {
-	s.CurrentDir, _ = os.Getwd()
+	var err error
+	s.jail, err = NewJail(s.Root)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	s.Sessions = make(map[string]*Session)
 
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", udp.Port))
+	if s.ListenAddr == "" {
+		s.ListenAddr = fmt.Sprintf(":%d", udp.Port)
+	}
+	addr, err := net.ResolveUDPAddr("udp", s.ListenAddr)
 	if err != nil {
 		fmt.Printf("Error resolving address: %v\n", err)
 		return
@@ -32,8 +100,64 @@ func (s *Server) RunServer() {
 	}
 	defer s.Conn.Close()
 
-	fmt.Printf("Server started on port %d\n", udp.Port)
-	s.handleRequests()
+	fmt.Printf("Server started on %s, serving %s\n", s.Conn.LocalAddr(), s.jail.Root)
+	announceUsers(s.Users)
+	if s.Key != nil {
+		fmt.Printf("Sessions are encrypted, server key %s\n", udp.PublicKey(s.Key))
+	}
+	go s.expireSessions()
+	go s.handleRequests()
+	s.awaitShutdown()
+}
+
+// awaitShutdown waits for SIGINT or SIGTERM, then tells every client the
+// server is going away and gives running transfers DrainTimeout to finish.
+// Those still running then, or when a second signal comes, are cut off;
+// an upload cut off this way has its partial file removed.
+func (s *Server) awaitShutdown() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	sig := <-signals
+	s.Draining.Store(true)
+	sessions := s.sessions()
+	fmt.Printf("Received %v, shutting down (%d sessions)\n", sig, len(sessions))
+	for _, session := range sessions {
+		if err := session.mux.Leave(ShutdownReason); err != nil {
+			fmt.Printf("[%s] Error sending goodbye: %v\n", session.Addr.String(), err)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.transfers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(DrainTimeout):
+		fmt.Printf("Transfers still running after %s, cutting them off\n", DrainTimeout)
+	case sig = <-signals:
+		fmt.Printf("Received %v again, cutting transfers off\n", sig)
+	}
+
+	for _, session := range s.sessions() {
+		session.mux.CloseAll()
+		s.removeSession(session, "closed for shutdown")
+	}
+	<-drained
+	fmt.Println("Server stopped")
+}
+
+func (s *Server) sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*Session, 0, len(s.Sessions))
+	for _, session := range s.Sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
 }
 
 func (s *Server) handleRequests() {
@@ -41,34 +165,301 @@ func (s *Server) handleRequests() {
 
 	for {
 		n, clientAddr, err := s.Conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Printf("Error reading from UDP: %v\n", err)
 			continue
 		}
 
-		command := string(buffer[:n])
+		datagram := append([]byte(nil), buffer[:n]...)
+		if session := s.session(clientAddr, datagram); session != nil {
+			session.mux.Deliver(datagram)
+		}
+	}
+}
+
+// session returns the session for addr, starting one if datagram is a
+// HELLO the server accepts, or nil if there is none.
+func (s *Server) session(addr *net.UDPAddr, datagram []byte) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := addr.String()
+	if session, ok := s.Sessions[key]; ok {
+		return session
+	}
+	if !s.admit(addr, datagram) {
+		return nil
+	}
+
+	mux := udp.NewMux(s.Conn, addr)
+	mux.EchoHeartbeats = true
+	mux.RequireSecure = s.Key != nil
+	session := &Session{
+		Addr:       addr,
+		CurrentDir: "/",
+		jail:       s.jail,
+		Commands:   mux.Open(udp.CommandStream, CommandQueueSize),
+		mux:        mux,
+		responses:  make(map[uint32]udp.Packet),
+		transfers:  &s.transfers,
+	}
+	s.Sessions[key] = session
+	fmt.Printf("[%s] New session (%d active)\n", key, len(s.Sessions))
+
+	go s.serveSession(session)
+	return session
+}
+
+// admit decides whether a datagram from addr, which has no session, may
+// start one. Only a HELLO the server would answer may: one it refuses is
+// answered with an ERROR here, and anything else is dropped, so that stray
+// and forged datagrams cost no session.
+func (s *Server) admit(addr *net.UDPAddr, datagram []byte) bool {
+	packet, err := udp.ParsePacket(datagram)
+	if err != nil || packet.Type != udp.TypeHello || packet.TransferID != udp.CommandStream {
+		return false
+	}
+	_, err = s.checkHello(packet.Payload)
+	if err == nil && s.Draining.Load() {
+		err = errors.New(ShutdownReason)
+	}
+	if err != nil {
+		fmt.Printf("[%s] Rejecting hello: %v\n", addr.String(), err)
+		refusal := &udp.Stream{ID: udp.CommandStream, Conn: s.Conn, Addr: addr}
+		_ = refusal.Send(udp.Packet{Type: udp.TypeError, Payload: []byte(err.Error())})
+		return false
+	}
+	return true
+}
+
+func (s *Server) removeSession(session *Session, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := session.Addr.String()
+	if s.Sessions[key] != session {
+		return
+	}
+	delete(s.Sessions, key)
+	session.mux.Close(udp.CommandStream)
+	fmt.Printf("[%s] Session %s (%d active)\n", key, reason, len(s.Sessions))
+}
+
+// expireSessions drops sessions whose client has sent nothing, not even a
+// heartbeat, for SessionIdleTimeout; the client is gone without a "quit".
+func (s *Server) expireSessions() {
+	ticker := time.NewTicker(udp.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var idle []*Session
+		s.mu.Lock()
+		for _, session := range s.Sessions {
+			if time.Since(session.mux.LastHeard()) > udp.SessionIdleTimeout {
+				idle = append(idle, session)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, session := range idle {
+			s.removeSession(session, "expired")
+		}
+	}
+}
+
+func (s *Server) serveSession(session *Session) {
+	for {
+		packet, err := session.Commands.Receive(time.Time{})
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		if packet.Type == udp.TypeProbe {
+			// Echo only the size, so the reply itself cannot be too big.
+			_ = session.Commands.Send(udp.Packet{Type: udp.TypeProbe, Seq: packet.Seq})
+			continue
+		}
+		if packet.Type == udp.TypeHello {
+			if s.Draining.Load() {
+				_ = session.Commands.Send(udp.Packet{Type: udp.TypeError, Payload: []byte(ShutdownReason)})
+				continue
+			}
+			s.welcome(session, packet)
+			continue
+		}
+		if packet.Type != udp.TypeCmd {
+			continue
+		}
+
+		command := string(packet.Payload)
 		parts := strings.Fields(command)
 		if len(parts) == 0 {
 			continue
 		}
 
-		s.ClientAddr = clientAddr
-		fmt.Printf("[%s] Command: %s\n", clientAddr.String(), command)
+		// A retried request is answered from the cache rather than run
+		// again, so commands like "cd .." take effect only once.
+		if cached, ok := session.cached(packet.Seq); ok {
+			fmt.Printf("[%s] Repeated request %d, replaying response\n", session.Addr.String(), packet.Seq)
+			if err := session.Commands.Send(cached); err != nil {
+				fmt.Printf("Error sending response: %v\n", err)
+			}
+			continue
+		}
+
+		fmt.Printf("[%s] Command %d: %s\n", session.Addr.String(), packet.Seq, udp.Redact(command))
 
-		response := s.processCommand(parts)
+		response := "error: " + ShutdownReason
+		if !s.Draining.Load() {
+			response = s.processCommand(session, packet.Seq, parts)
+		}
 		if response != "" {
-			if _, err := s.Conn.WriteToUDP([]byte(response), clientAddr); err != nil {
+			if err := session.reply(packet.Seq, response, 0); err != nil {
 				fmt.Printf("Error sending response: %v\n", err)
 			}
 		}
+		if response == "goodbye!" {
+			s.removeSession(session, "closed")
+			return
+		}
+		if response == LoginLimitNotice {
+			s.removeSession(session, "closed after failed logins")
+			return
+		}
+	}
+}
+
+// welcome answers a client's HELLO with this server's version and
+// capabilities, and its half of the key exchange if it has a key, or
+// refuses a version it does not speak. A HELLO starts the session afresh,
+// so replies cached for an earlier client on the same address are
+// forgotten. Anyone can send a HELLO in the client's name, though, so once
+// the session is keyed, only a repeat of the HELLO that keyed it is
+// answered, with the same WELCOME, in case the first was lost.
+func (s *Server) welcome(session *Session, packet udp.Packet) {
+	if session.mux.Secured() {
+		if bytes.Equal(packet.Payload, session.hello) {
+			_ = session.Commands.Send(session.welcomed)
+		}
+		return
+	}
+
+	hello, err := s.checkHello(packet.Payload)
+	reply := udp.Packet{Type: udp.TypeWelcome, Payload: []byte(udp.LocalHello().String())}
+	var cipher *udp.Cipher
+	if err == nil && s.Key != nil {
+		reply.Payload, cipher, err = udp.AcceptKeyExchange(s.Key, s.PSK, packet.Payload, hello)
+	}
+	if err != nil {
+		fmt.Printf("[%s] Rejecting hello: %v\n", session.Addr.String(), err)
+		_ = session.Commands.Send(udp.Packet{Type: udp.TypeError, Payload: []byte(err.Error())})
+		return
+	}
+
+	session.mu.Lock()
+	clear(session.responses)
+	session.order = nil
+	session.mu.Unlock()
+
+	fmt.Printf("[%s] Hello: version=%d caps=%s\n", session.Addr.String(), hello.Version, strings.Join(hello.Capabilities, ","))
+	if cipher != nil {
+		// The WELCOME itself goes in the clear; what follows is sealed.
+		session.hello, session.welcomed = packet.Payload, reply
+		session.mux.Secure(cipher)
+		fmt.Printf("[%s] Session encrypted\n", session.Addr.String())
+	}
+	if err := session.Commands.Send(reply); err != nil {
+		fmt.Printf("Error sending welcome: %v\n", err)
+	}
+}
+
+// checkHello parses a HELLO and checks that the server can answer it.
+func (s *Server) checkHello(payload []byte) (udp.Hello, error) {
+	hello, err := udp.ParseHello(payload)
+	if err == nil && hello.Version != int(udp.Version) {
+		err = fmt.Errorf("unsupported protocol version %d", hello.Version)
+	}
+	if err == nil && s.Key != nil && hello.Key == nil {
+		err = errors.New("server requires encryption")
+	}
+	return hello, err
+}
+
+// reply answers request id and remembers the answer for retries. A later
+// notification for the same request replaces the cached reply. A response
+// larger than the session's chunk size is announced with FlagStream and
+// its length, then sent on the request's stream with the file transfer
+// machinery and the options of the last transfer, which the client
+// receives it with.
+func (session *Session) reply(id uint32, response string, flags uint16) error {
+	session.mu.Lock()
+	options := udp.ReplyOptions(session.options, session.Commands)
+	session.mu.Unlock()
+
+	packet := udp.Packet{Type: udp.TypeCmd, Flags: flags, Seq: id, Payload: []byte(response)}
+	if len(response) > options.ChunkSize {
+		packet.Flags |= udp.FlagStream
+		packet.Payload = []byte(strconv.Itoa(len(response)))
+		stream := session.openTransfer(id)
+		go func() {
+			defer session.closeTransfer(stream)
+			if err := udp.UploadBytes([]byte(response), stream, options); err != nil {
+				fmt.Printf("[%s] Sending response %d failed: %v\n", session.Addr.String(), id, err)
+			}
+		}()
+	}
+
+	session.mu.Lock()
+	if _, ok := session.responses[id]; !ok {
+		session.order = append(session.order, id)
+		if len(session.order) > ResponseCacheSize {
+			delete(session.responses, session.order[0])
+			session.order = session.order[1:]
+		}
 	}
+	session.responses[id] = packet
+	session.mu.Unlock()
+
+	return session.Commands.Send(packet)
+}
+
+func (session *Session) cached(id uint32) (udp.Packet, bool) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	packet, ok := session.responses[id]
+	return packet, ok
+}
+
+// openTransfer registers the stream for the data request id sends or
+// receives. It reuses the request ID, which the client has already opened
+// its end under, so no packet is sent before the client can take it.
+// A shutdown waits for the transfer until closeTransfer.
+func (session *Session) openTransfer(id uint32) *udp.Stream {
+	session.transfers.Add(1)
+	return session.mux.Open(id, TransferQueueSize)
+}
+
+func (session *Session) closeTransfer(stream *udp.Stream) {
+	session.mux.Close(stream.ID)
+	session.transfers.Done()
 }
 
-func (s *Server) processCommand(parts []string) string {
+func (s *Server) processCommand(session *Session, id uint32, parts []string) string {
 	cmd := strings.ToLower(parts[0])
 	args := parts[1:]
 
+	if denied := authorize(s.Users, session.user, cmd); denied != "" {
+		return denied
+	}
+
 	switch cmd {
+	case "login":
+		return s.handleLogin(session, args...)
 	case "echo":
 		return strings.Join(args, " ")
 	case "time":
@@ -76,24 +467,59 @@ func (s *Server) processCommand(parts []string) string {
 	case "quit", "exit", "close":
 		return "goodbye!"
 	case "ls":
-		return s.listDirectory()
+		return session.listDirectory()
 	case "cd":
-		return s.changeDirectory(args...)
+		return session.changeDirectory(args...)
+	case "pwd":
+		return handlePwd(session.CurrentDir)
+	case "mkdir":
+		return handleMkdir(session.jail, session.CurrentDir, args...)
+	case "rm":
+		return handleRm(session.jail, session.CurrentDir, args...)
+	case "rmdir":
+		return handleRmdir(session.jail, session.CurrentDir, args...)
+	case "mv", "rename":
+		return handleMv(session.jail, session.CurrentDir, args...)
+	case "cp":
+		return handleCp(session.jail, session.CurrentDir, args...)
+	case "stat":
+		return handleStat(session.jail, session.CurrentDir, args...)
 	case "upload":
-		go s.handleUpload(args...)
-		return "ready"
+		return s.handleUpload(session, id, args...)
 	case "download":
-		go s.handleDownload(args...)
-		return "ready"
+		return s.handleDownload(session, id, args...)
 	default:
 		return "error: unknown command"
 	}
 }
 
-func (s *Server) listDirectory() string {
-	files, err := os.ReadDir(s.CurrentDir)
+// handleLogin logs the session in and moves it to its home directory.
+func (s *Server) handleLogin(session *Session, args ...string) string {
+	if s.Users == nil {
+		return "error: this server does not require a login"
+	}
+	user, home, err := login(s.Users, s.jail, args)
+	if err != nil {
+		session.failures++
+		fmt.Printf("[%s] Login failed: %v\n", session.Addr.String(), err)
+		if session.failures >= MaxLoginAttempts {
+			return LoginLimitNotice
+		}
+		return fmt.Sprintf("error: %v", err)
+	}
+	session.user, session.jail, session.CurrentDir, session.failures = user, home, "/", 0
+	fmt.Printf("[%s] Logged in as %s (%s)\n", session.Addr.String(), user.Name, user.Role)
+	return fmt.Sprintf("logged in as %s (%s)", user.Name, user.Role)
+}
+
+func (session *Session) listDirectory() string {
+	dir, _, err := session.jail.Resolve(session.CurrentDir, ".")
 	if err != nil {
-		return fmt.Sprintf("Error reading directory: %v", err)
+		return fmt.Sprintf("error: %v", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Sprintf("Error reading directory %s", session.CurrentDir)
 	}
 
 	var result []string
@@ -107,66 +533,111 @@ func (s *Server) listDirectory() string {
 	return strings.Join(result, "\n")
 }
 
-func (s *Server) changeDirectory(args ...string) string {
+func (session *Session) changeDirectory(args ...string) string {
 	if len(args) == 0 {
 		return "error: path required"
 	}
 
-	newPath := filepath.Join(s.CurrentDir, args[0])
-	absPath, err := filepath.Abs(newPath)
+	realPath, newDir, err := session.jail.Resolve(session.CurrentDir, args[0])
 	if err != nil {
 		return fmt.Sprintf("error: %v", err)
 	}
 
-	info, err := os.Stat(absPath)
+	info, err := os.Stat(realPath)
 	if err != nil || !info.IsDir() {
-		return fmt.Sprintf("error: %s is not a valid directory", absPath)
+		return fmt.Sprintf("error: %s is not a valid directory", newDir)
 	}
 
-	s.CurrentDir = absPath
-	return fmt.Sprintf("Changed directory to %s", absPath)
+	session.CurrentDir = newDir
+	return fmt.Sprintf("Changed directory to %s", newDir)
 }
 
-func (s *Server) handleDownload(args ...string) {
+// handleDownload checks the request, then sends the file on a new transfer
+// stream in the background. The "ready <id>" reply tells the client which
+// stream to listen on; the outcome follows later on the command channel as
+// a notification for the same request.
+func (s *Server) handleDownload(session *Session, id uint32, args ...string) string {
 	if len(args) == 0 {
-		_, _ = s.Conn.WriteToUDP([]byte("error: filename required"), s.ClientAddr)
-		return
+		return "error: filename required"
 	}
 
-	fileName := args[0]
-	filePath := filepath.Join(s.CurrentDir, fileName)
-
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		_, _ = s.Conn.WriteToUDP([]byte("error: file not found"), s.ClientAddr)
-		return
+	filePath, _, err := session.jail.Resolve(session.CurrentDir, args[0])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if info, err := os.Stat(filePath); err != nil || info.IsDir() {
+		return "error: file not found"
 	}
 
-	if err := udp.Upload(filePath, s.Conn, s.ClientAddr); err != nil {
-		_, _ = s.Conn.WriteToUDP([]byte("error: download failed"), s.ClientAddr)
-		return
+	options, err := udp.ParseTransferOptions(args[1:])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
 	}
 
-	_, _ = s.Conn.WriteToUDP([]byte("download complete"), s.ClientAddr)
+	stream := session.openTransfer(id)
+	go func() {
+		defer session.closeTransfer(stream)
+		if err := udp.Upload(filePath, stream, options); err != nil {
+			fmt.Printf("[%s] Download failed: %v\n", session.Addr.String(), err)
+			_ = session.reply(id, "error: download failed", udp.FlagNotify)
+			return
+		}
+		_ = session.reply(id, "download complete", udp.FlagNotify)
+	}()
+	return session.readyResponse(stream, options)
 }
 
-func (s *Server) handleUpload(args ...string) {
+func (s *Server) handleUpload(session *Session, id uint32, args ...string) string {
 	if len(args) == 0 {
-		_, _ = s.Conn.WriteToUDP([]byte("error: filename required"), s.ClientAddr)
-		return
+		return "error: filename required"
 	}
 
-	fileName := args[0]
-	filePath := filepath.Join(s.CurrentDir, fileName)
+	filePath, virtual, err := session.jail.Resolve(session.CurrentDir, args[0])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if virtual == "/" {
+		return "error: filename required"
+	}
 
-	if _, err := os.Stat(filePath); err == nil {
-		_, _ = s.Conn.WriteToUDP([]byte("error: file exists"), s.ClientAddr)
-		return
+	options, err := udp.ParseTransferOptions(args[1:])
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
 	}
+	options.ReceiveTimeout = s.ReceiveTimeout
 
-	if err := udp.Download(filePath, s.Conn, s.ClientAddr); err != nil {
-		_, _ = s.Conn.WriteToUDP([]byte("error: upload failed"), s.ClientAddr)
-		return
+	// O_EXCL refuses an existing file and, like noFollow, a symlink put
+	// there to lead the upload out of the jail.
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|noFollow, 0666)
+	if os.IsExist(err) {
+		return "error: file exists"
 	}
+	if err != nil {
+		return session.jail.Hide(fmt.Sprintf("error: %v", err))
+	}
+
+	// A login may replace the session's jail while the upload runs.
+	jail := session.jail
+	stream := session.openTransfer(id)
+	go func() {
+		defer session.closeTransfer(stream)
+		if err := udp.Download(file, stream, options); err != nil {
+			fmt.Printf("[%s] Upload failed: %v\n", session.Addr.String(), err)
+			_ = session.reply(id, jail.Hide(fmt.Sprintf("error: upload failed: %v", err)), udp.FlagNotify)
+			return
+		}
+		_ = session.reply(id, "upload complete", udp.FlagNotify)
+		udp.Linger(stream)
+	}()
+	return session.readyResponse(stream, options)
+}
 
-	_, _ = s.Conn.WriteToUDP([]byte("upload complete"), s.ClientAddr)
+// readyResponse tells the client which stream the transfer runs on and
+// which of its proposed options are in force. They stay in force for the
+// replies that follow, as the client takes them from this one.
+func (session *Session) readyResponse(stream *udp.Stream, options udp.TransferOptions) string {
+	session.mu.Lock()
+	session.options = udp.TransferOptions{FECBlock: options.FECBlock, ChunkSize: options.ChunkSize}
+	session.mu.Unlock()
+	return strings.TrimSpace(fmt.Sprintf("ready %d %s", stream.ID, options))
 }
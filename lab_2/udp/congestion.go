@@ -0,0 +1,87 @@
+package udp
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	MinRTO           = 200 * time.Millisecond
+	MaxRTO           = 10 * time.Second
+	DupAckLimit      = 3
+	InitialWindow    = 2
+	MaxPacketRetries = 10
+)
+
+// congestionControl estimates the retransmission timeout with the
+// Jacobson/Karels algorithm (RFC 6298) and sizes the send window like TCP
+// Reno: slow start, additive increase, halving on fast retransmit and
+// falling back to one packet on timeout.
+type congestionControl struct {
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	cwnd     float64
+	ssthresh float64
+	recover  uint32
+}
+
+func newCongestionControl() *congestionControl {
+	return &congestionControl{
+		rto:      AckTimeout,
+		cwnd:     InitialWindow,
+		ssthresh: WindowSize,
+	}
+}
+
+// window returns how many packets may be in flight.
+func (c *congestionControl) window() uint32 {
+	return uint32(math.Max(1, math.Min(c.cwnd, WindowSize)))
+}
+
+// sampleRTT feeds a round-trip measurement. Per Karn's rule callers only
+// pass samples for packets that were never retransmitted.
+func (c *congestionControl) sampleRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.setRTO(c.srtt + 4*c.rttvar)
+}
+
+func (c *congestionControl) onAck() {
+	if c.cwnd < c.ssthresh {
+		c.cwnd++
+	} else {
+		c.cwnd += 1 / c.cwnd
+	}
+}
+
+// onFastRetransmit halves the window at most once per window of data:
+// losses below recover belong to the event that already cut it.
+func (c *congestionControl) onFastRetransmit(seq, nextSeq uint32) {
+	if seq < c.recover {
+		return
+	}
+	c.recover = nextSeq
+	c.ssthresh = math.Max(c.cwnd/2, 2)
+	c.cwnd = c.ssthresh
+}
+
+func (c *congestionControl) onTimeout(nextSeq uint32) {
+	c.recover = nextSeq
+	c.ssthresh = math.Max(c.cwnd/2, 2)
+	c.cwnd = 1
+	c.setRTO(2 * c.rto)
+}
+
+func (c *congestionControl) setRTO(rto time.Duration) {
+	c.rto = min(max(rto, MinRTO), MaxRTO)
+}
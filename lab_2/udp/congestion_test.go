@@ -0,0 +1,93 @@
+package udp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTOEstimate(t *testing.T) {
+	c := newCongestionControl()
+
+	// The first sample sets SRTT to it and RTTVAR to half of it.
+	c.sampleRTT(400 * time.Millisecond)
+	if c.srtt != 400*time.Millisecond || c.rttvar != 200*time.Millisecond || c.rto != 1200*time.Millisecond {
+		t.Fatalf("after the first sample srtt=%v rttvar=%v rto=%v, want 400ms 200ms 1.2s", c.srtt, c.rttvar, c.rto)
+	}
+
+	// Later ones are smoothed with gains of 1/8 and 1/4.
+	c.sampleRTT(800 * time.Millisecond)
+	if c.srtt != 450*time.Millisecond || c.rttvar != 250*time.Millisecond || c.rto != 1450*time.Millisecond {
+		t.Fatalf("after the second sample srtt=%v rttvar=%v rto=%v, want 450ms 250ms 1.45s", c.srtt, c.rttvar, c.rto)
+	}
+
+	// A fast, steady path is held at MinRTO.
+	for i := 0; i < 50; i++ {
+		c.sampleRTT(time.Millisecond)
+	}
+	if c.rto != MinRTO {
+		t.Errorf("rto = %v on a 1ms path, want MinRTO", c.rto)
+	}
+
+	// Timeouts back off exponentially up to MaxRTO.
+	for i := 0; i < 10; i++ {
+		c.onTimeout(0)
+	}
+	if c.rto != MaxRTO {
+		t.Errorf("rto = %v after repeated timeouts, want MaxRTO", c.rto)
+	}
+}
+
+func TestCongestionWindow(t *testing.T) {
+	c := newCongestionControl()
+	if c.window() != InitialWindow {
+		t.Fatalf("window starts at %d, want %d", c.window(), InitialWindow)
+	}
+
+	// Slow start grows the window by one per ACK, up to WindowSize.
+	for i := 0; i < 4; i++ {
+		c.onAck()
+	}
+	if c.window() != InitialWindow+4 {
+		t.Fatalf("window is %d after 4 ACKs in slow start, want %d", c.window(), InitialWindow+4)
+	}
+	for i := 0; i < 2*WindowSize; i++ {
+		c.onAck()
+	}
+	if c.window() != WindowSize {
+		t.Fatalf("window is %d, want it capped at %d", c.window(), WindowSize)
+	}
+
+	// A fast retransmit halves it, once per window of data.
+	c.cwnd = 20
+	c.onFastRetransmit(100, 120)
+	if c.cwnd != 10 || c.ssthresh != 10 {
+		t.Fatalf("after fast retransmit cwnd=%v ssthresh=%v, want 10 10", c.cwnd, c.ssthresh)
+	}
+	c.onFastRetransmit(110, 125)
+	if c.cwnd != 10 {
+		t.Fatalf("a second loss in the same window cut cwnd to %v", c.cwnd)
+	}
+	c.onFastRetransmit(120, 130)
+	if c.cwnd != 5 {
+		t.Fatalf("a loss in the next window left cwnd at %v, want 5", c.cwnd)
+	}
+
+	// Above ssthresh the window grows by about one per window of ACKs.
+	for i := 0; i < 5; i++ {
+		c.onAck()
+	}
+	if c.window() != 5 {
+		t.Fatalf("window is %d after 5 ACKs in congestion avoidance from 5, want 5", c.window())
+	}
+	c.onAck()
+	if c.window() != 6 {
+		t.Fatalf("window is %d after a full window of ACKs, want 6", c.window())
+	}
+
+	// A timeout drops it to one packet.
+	cwnd := c.cwnd
+	c.onTimeout(130)
+	if c.window() != 1 || c.ssthresh != cwnd/2 {
+		t.Errorf("after a timeout window=%d ssthresh=%v, want 1 %v", c.window(), c.ssthresh, cwnd/2)
+	}
+}
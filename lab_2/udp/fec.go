@@ -0,0 +1,176 @@
+package udp
+
+import "encoding/binary"
+
+// MaxFECBlock caps how many data packets one parity packet may cover.
+const MaxFECBlock = 64
+
+// parityHeaderSize is the count of covered packets and the XOR of their
+// lengths that precede the XOR of their payloads.
+const parityHeaderSize = 4
+
+// parityEncoder builds one XOR parity packet per block of data packets.
+// Block boundaries are fixed multiples of the block size in sequence
+// numbers, so both sides agree on them without extra signalling.
+type parityEncoder struct {
+	block   int
+	start   uint32
+	count   int
+	lengths uint16
+	xor     []byte
+}
+
+func newParityEncoder(block, chunkSize int) *parityEncoder {
+	return &parityEncoder{block: block, xor: make([]byte, chunkSize)}
+}
+
+// add folds a data packet into the current block and returns the block's
+// parity packet once it is full.
+func (e *parityEncoder) add(seq uint32, data []byte) *Packet {
+	if e.count == 0 {
+		e.start = seq
+	}
+	e.count++
+	e.lengths ^= uint16(len(data))
+	xorInto(e.xor, data)
+	if e.count < e.block {
+		return nil
+	}
+	return e.flush()
+}
+
+// flush returns the parity packet for a partial block, if any.
+func (e *parityEncoder) flush() *Packet {
+	if e.count == 0 {
+		return nil
+	}
+	payload := make([]byte, parityHeaderSize+len(e.xor))
+	binary.BigEndian.PutUint16(payload[0:2], uint16(e.count))
+	binary.BigEndian.PutUint16(payload[2:4], e.lengths)
+	copy(payload[parityHeaderSize:], e.xor)
+
+	e.count = 0
+	e.lengths = 0
+	clear(e.xor)
+	return &Packet{Type: TypeParity, Seq: e.start, Payload: payload}
+}
+
+// fecBlock is the receiver's running XOR of one block.
+type fecBlock struct {
+	count    int
+	received []bool
+	got      int
+	lengths  uint16
+	xor      []byte
+	parity   bool
+}
+
+// parityDecoder rebuilds the one missing data packet of a block from the
+// others and the block's parity packet. A block is dropped once complete,
+// and remembered in done until delivery passes it, so that its parity
+// arriving late does not open it again.
+type parityDecoder struct {
+	block  int
+	blocks map[uint32]*fecBlock
+	done   map[uint32]bool
+}
+
+func newParityDecoder(block int) *parityDecoder {
+	return &parityDecoder{block: block, blocks: make(map[uint32]*fecBlock), done: make(map[uint32]bool)}
+}
+
+func (d *parityDecoder) get(start uint32) *fecBlock {
+	b, ok := d.blocks[start]
+	if !ok {
+		b = &fecBlock{count: d.block, received: make([]bool, d.block)}
+		d.blocks[start] = b
+	}
+	return b
+}
+
+// addData records a data packet seen for the first time and returns a
+// recovered packet if that leaves exactly one missing.
+func (d *parityDecoder) addData(seq uint32, data []byte) (uint32, []byte, bool) {
+	start := seq - seq%uint32(d.block)
+	if d.done[start] {
+		return 0, nil, false
+	}
+	b := d.get(start)
+	b.received[seq-start] = true
+	b.got++
+	b.lengths ^= uint16(len(data))
+	b.xor = xorGrow(b.xor, data)
+	return d.recover(start, b)
+}
+
+// addParity records a parity packet. Blocks that ended before expected
+// were delivered in full and need no parity.
+func (d *parityDecoder) addParity(p Packet, expected uint32) (uint32, []byte, bool) {
+	if len(p.Payload) < parityHeaderSize || p.Seq%uint32(d.block) != 0 {
+		return 0, nil, false
+	}
+	count := int(binary.BigEndian.Uint16(p.Payload[0:2]))
+	if count == 0 || count > d.block || p.Seq+uint32(count) <= expected {
+		return 0, nil, false
+	}
+	for start := range d.done {
+		if start+uint32(d.block) <= expected {
+			delete(d.done, start)
+		}
+	}
+	if d.done[p.Seq] {
+		return 0, nil, false
+	}
+
+	b := d.get(p.Seq)
+	if b.parity {
+		return 0, nil, false
+	}
+	b.parity = true
+	b.count = count
+	b.lengths ^= binary.BigEndian.Uint16(p.Payload[2:4])
+	b.xor = xorGrow(b.xor, p.Payload[parityHeaderSize:])
+	return d.recover(p.Seq, b)
+}
+
+func (d *parityDecoder) recover(start uint32, b *fecBlock) (uint32, []byte, bool) {
+	if b.got >= b.count {
+		d.finish(start)
+		return 0, nil, false
+	}
+	if !b.parity || b.got != b.count-1 {
+		return 0, nil, false
+	}
+
+	d.finish(start)
+	for i := 0; i < b.count; i++ {
+		if !b.received[i] {
+			length := int(b.lengths)
+			if length > len(b.xor) {
+				return 0, nil, false
+			}
+			return start + uint32(i), b.xor[:length], true
+		}
+	}
+	return 0, nil, false
+}
+
+func (d *parityDecoder) finish(start uint32) {
+	delete(d.blocks, start)
+	d.done[start] = true
+}
+
+func xorInto(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// xorGrow XORs src into dst, extending dst with zeros to fit.
+func xorGrow(dst, src []byte) []byte {
+	if len(dst) < len(src) {
+		dst = append(dst, make([]byte, len(src)-len(dst))...)
+	}
+	xorInto(dst, src)
+	return dst
+}
@@ -0,0 +1,127 @@
+package udp
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// fecBlockData returns count payloads of different lengths, the last one
+// short, as the last chunk of a file usually is.
+func fecBlockData(count, chunkSize int) [][]byte {
+	data := make([][]byte, count)
+	for i := range data {
+		size := chunkSize - i
+		if i == count-1 {
+			size = chunkSize / 3
+		}
+		data[i] = bytes.Repeat([]byte{byte('a' + i)}, size)
+	}
+	return data
+}
+
+// encodeBlock feeds data, starting at seq start, to a fresh encoder and
+// returns the parity packet of the block.
+func encodeBlock(t *testing.T, block, chunkSize int, start uint32, data [][]byte) Packet {
+	t.Helper()
+	e := newParityEncoder(block, chunkSize)
+	var parity *Packet
+	for i, payload := range data {
+		parity = e.add(start+uint32(i), payload)
+	}
+	if len(data) < block {
+		parity = e.flush()
+	}
+	if parity == nil {
+		t.Fatal("no parity packet for a complete block")
+	}
+	return *parity
+}
+
+func TestParityRecoversLostPacket(t *testing.T) {
+	const block, chunkSize = 4, 32
+	for _, count := range []int{block, block - 1} {
+		for lost := 0; lost < count; lost++ {
+			for _, parityFirst := range []bool{false, true} {
+				t.Run(fmt.Sprintf("count=%d/lost=%d/parityFirst=%v", count, lost, parityFirst), func(t *testing.T) {
+					start := uint32(2 * block)
+					data := fecBlockData(count, chunkSize)
+					parity := encodeBlock(t, block, chunkSize, start, data)
+					d := newParityDecoder(block)
+
+					var seq uint32
+					var payload []byte
+					var ok bool
+					if parityFirst {
+						seq, payload, ok = d.addParity(parity, start)
+					}
+					for i := range data {
+						if i == lost {
+							continue
+						}
+						if seq, payload, ok = d.addData(start+uint32(i), data[i]); ok {
+							break
+						}
+					}
+					if !parityFirst {
+						seq, payload, ok = d.addParity(parity, start)
+					}
+
+					if !ok {
+						t.Fatal("lost packet was not recovered")
+					}
+					if seq != start+uint32(lost) || !bytes.Equal(payload, data[lost]) {
+						t.Errorf("recovered seq %d (%d bytes), want seq %d (%d bytes)",
+							seq, len(payload), start+uint32(lost), len(data[lost]))
+					}
+					if len(d.blocks) != 0 {
+						t.Errorf("%d blocks left open after recovery", len(d.blocks))
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestParityTwoLostPackets(t *testing.T) {
+	const block, chunkSize = 4, 32
+	data := fecBlockData(block, chunkSize)
+	parity := encodeBlock(t, block, chunkSize, 0, data)
+	d := newParityDecoder(block)
+	for i := 2; i < block; i++ {
+		if _, _, ok := d.addData(uint32(i), data[i]); ok {
+			t.Fatal("recovered a packet with two missing")
+		}
+	}
+	if _, _, ok := d.addParity(parity, 0); ok {
+		t.Fatal("recovered a packet with two missing")
+	}
+}
+
+func TestLateParityDoesNotReopenBlock(t *testing.T) {
+	const block, chunkSize = 4, 32
+	data := fecBlockData(block, chunkSize)
+	parity := encodeBlock(t, block, chunkSize, block, data)
+	d := newParityDecoder(block)
+
+	// The whole block arrives ahead of delivery, which still waits on
+	// seq 0, and its parity only after that.
+	for i := range data {
+		if _, _, ok := d.addData(block+uint32(i), data[i]); ok {
+			t.Fatal("recovered a packet that was not lost")
+		}
+	}
+	if _, _, ok := d.addParity(parity, 0); ok {
+		t.Fatal("recovered a packet that was not lost")
+	}
+	if len(d.blocks) != 0 {
+		t.Errorf("late parity left %d blocks open", len(d.blocks))
+	}
+
+	// Once delivery passes the block, it is forgotten altogether.
+	next := encodeBlock(t, block, chunkSize, 3*block, data)
+	d.addParity(next, 2*block)
+	if d.done[block] {
+		t.Error("block still remembered after delivery passed it")
+	}
+}
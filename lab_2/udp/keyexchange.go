@@ -0,0 +1,286 @@
+package udp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The key exchange rides on HELLO and WELCOME and follows the Noise NX
+// pattern over X25519:
+//
+//	HELLO    -> e
+//	WELCOME  <- e, ee, s, es, proof
+//
+// The client sends a fresh ephemeral key. The server answers with its own
+// ephemeral key, its long-term static key and a proof: a tag made with a
+// key derived from both Diffie-Hellman results, which only the holder of
+// the static key can compute. Both sides derive one key per direction with
+// HKDF-SHA256, salted with the hash of the whole exchange so that nothing
+// in it can be altered unnoticed. A pre-shared key, if set, is mixed in as
+// well, so that only clients that know it get a session. The client
+// decides whether to trust the static key itself, see ServerTrust.
+const handshakeLabel = "NSSDS UDP NX X25519 ChaCha20-Poly1305 SHA256"
+
+var ErrNoEncryption = errors.New("server does not offer encryption")
+
+// Security is what a client needs to encrypt its session: the trust it
+// puts in server keys and the pre-shared key, if any.
+type Security struct {
+	Trust ServerTrust
+	PSK   string
+}
+
+// AcceptKeyExchange is the server side: given the client's HELLO, as sent
+// and as parsed, it returns the WELCOME to answer with and the session's
+// cipher.
+func AcceptKeyExchange(static *ecdh.PrivateKey, psk string, helloPayload []byte, hello Hello) ([]byte, *Cipher, error) {
+	clientKey, err := ecdh.X25519().NewPublicKey(hello.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad client key: %v", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ee, err := ephemeral.ECDH(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	es, err := static.ECDH(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	welcome := LocalHello()
+	welcome.Key = ephemeral.PublicKey().Bytes()
+	welcome.Static = static.PublicKey().Bytes()
+	transcript := transcriptHash(helloPayload, []byte(welcome.String()))
+	toServer, toClient, confirm, err := deriveKeys(ee, es, psk, transcript)
+	if err != nil {
+		return nil, nil, err
+	}
+	welcome.Proof, err = prove(confirm, transcript)
+	if err != nil {
+		return nil, nil, err
+	}
+	cipher, err := newCipher(toClient, toServer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(welcome.String()), cipher, nil
+}
+
+// keyExchange is the client side of an exchange in progress.
+type keyExchange struct {
+	security  *Security
+	ephemeral *ecdh.PrivateKey
+}
+
+func newKeyExchange(security *Security) (*keyExchange, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &keyExchange{security: security, ephemeral: ephemeral}, nil
+}
+
+// finish checks the server's WELCOME, answering a HELLO with helloPayload
+// from addr, and returns the session's cipher.
+func (kx *keyExchange) finish(addr string, helloPayload, welcomePayload []byte, welcome Hello) (*Cipher, error) {
+	if welcome.Key == nil || welcome.Static == nil || welcome.Proof == nil {
+		return nil, ErrNoEncryption
+	}
+	serverKey, err := ecdh.X25519().NewPublicKey(welcome.Key)
+	if err != nil {
+		return nil, fmt.Errorf("bad server key: %v", err)
+	}
+	staticKey, err := ecdh.X25519().NewPublicKey(welcome.Static)
+	if err != nil {
+		return nil, fmt.Errorf("bad server key: %v", err)
+	}
+	ee, err := kx.ephemeral.ECDH(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	es, err := kx.ephemeral.ECDH(staticKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The proof is the last field of the WELCOME and covers all before it.
+	signed, _, _ := bytes.Cut(welcomePayload, []byte(" proof="))
+	transcript := transcriptHash(helloPayload, signed)
+	toServer, toClient, confirm, err := deriveKeys(ee, es, kx.security.PSK, transcript)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(confirm, transcript, welcome.Proof); err != nil {
+		if kx.security.PSK != "" {
+			return nil, errors.New("server could not prove its key (wrong pre-shared key?)")
+		}
+		return nil, errors.New("server could not prove its key")
+	}
+	if err := kx.security.Trust.Verify(addr, welcome.Static); err != nil {
+		return nil, err
+	}
+	return newCipher(toServer, toClient)
+}
+
+// transcriptHash binds the keys to everything both sides said.
+func transcriptHash(hello, welcome []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(handshakeLabel))
+	binary.Write(h, binary.BigEndian, uint32(len(hello)))
+	h.Write(hello)
+	h.Write(welcome)
+	return h.Sum(nil)
+}
+
+// deriveKeys returns the client-to-server and server-to-client keys and
+// the key of the server's proof.
+func deriveKeys(ee, es []byte, psk string, transcript []byte) (toServer, toClient, confirm []byte, err error) {
+	secret := append(append([]byte(nil), ee...), es...)
+	if psk != "" {
+		sum := sha256.Sum256([]byte(psk))
+		secret = append(secret, sum[:]...)
+	}
+	keys, err := hkdf.Key(sha256.New, secret, transcript, handshakeLabel, 3*chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	size := chacha20poly1305.KeySize
+	return keys[:size], keys[size : 2*size], keys[2*size:], nil
+}
+
+func prove(key, transcript []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce(0), nil, transcript), nil
+}
+
+func verify(key, transcript, proof []byte) error {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+	_, err = aead.Open(nil, nonce(0), proof, transcript)
+	return err
+}
+
+// ServerTrust says how a client checks the server's static key: against
+// Pin, the key in hex as GenerateKey prints it, if set, and otherwise by
+// trusting it on first use and remembering it in KnownHosts
+// (~/.nssds_udp_known_hosts if empty).
+type ServerTrust struct {
+	Pin        string
+	KnownHosts string
+}
+
+// Verify accepts or refuses key as the static key of the server at addr.
+func (t ServerTrust) Verify(addr string, key []byte) error {
+	got := hex.EncodeToString(key)
+	if t.Pin != "" {
+		if pin := strings.ToLower(strings.TrimSpace(t.Pin)); got != pin {
+			return fmt.Errorf("server key %s does not match the pinned %s", got, pin)
+		}
+		return nil
+	}
+	knownHosts, err := t.knownHosts()
+	if err != nil {
+		return err
+	}
+	return trustOnFirstUse(knownHosts, addr, got)
+}
+
+func (t ServerTrust) knownHosts() (string, error) {
+	if t.KnownHosts != "" {
+		return t.KnownHosts, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("no known hosts file: %v", err)
+	}
+	return filepath.Join(home, ".nssds_udp_known_hosts"), nil
+}
+
+// trustOnFirstUse accepts the key of addr if it is the one seen before,
+// or, if addr is new, records it in the known hosts file, which holds one
+// "addr key" line per server.
+func trustOnFirstUse(knownHosts, addr, key string) error {
+	file, err := os.OpenFile(knownHosts, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening known hosts: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != addr {
+			continue
+		}
+		if fields[1] != key {
+			return fmt.Errorf("key of %s has changed to %s; if that is expected, remove its line from %s",
+				addr, key, knownHosts)
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading known hosts: %v", err)
+	}
+
+	if _, err := fmt.Fprintf(file, "%s %s\n", addr, key); err != nil {
+		return fmt.Errorf("error writing known hosts: %v", err)
+	}
+	Logger.Printf("Trusting the key of %s on first use: %s", addr, key)
+	return nil
+}
+
+// GenerateKey writes a new static key for a server to file and returns
+// its public half in hex, for clients to pin.
+func GenerateKey(file string) (string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("error generating key: %v", err)
+	}
+	if err := os.WriteFile(file, []byte(hex.EncodeToString(key.Bytes())+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("error writing %s: %v", file, err)
+	}
+	return PublicKey(key), nil
+}
+
+// LoadKey reads a static key written by GenerateKey.
+func LoadKey(file string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key: %v", err)
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err == nil {
+		var key *ecdh.PrivateKey
+		if key, err = ecdh.X25519().NewPrivateKey(raw); err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("bad key in %s: %v", file, err)
+}
+
+// PublicKey returns the public half of key in hex.
+func PublicKey(key *ecdh.PrivateKey) string {
+	return hex.EncodeToString(key.PublicKey().Bytes())
+}
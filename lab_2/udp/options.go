@@ -0,0 +1,89 @@
+package udp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReceiveTimeout is how long a receiver waits for the next packet of a
+// transfer when its options leave ReceiveTimeout at 0.
+const ReceiveTimeout = 30 * time.Second
+
+// TransferOptions are negotiated per transfer: the client proposes them
+// with the upload or download command and the server's "ready" reply
+// carries the values both sides then use. ReceiveTimeout is the exception:
+// each side sets its own and it is not sent.
+type TransferOptions struct {
+	// FECBlock is the number of data packets covered by one parity
+	// packet; 0 disables forward error correction.
+	FECBlock int
+	// ChunkSize is the file data carried per packet; 0 means ChunkSize.
+	ChunkSize int
+	// ReceiveTimeout is how long the receiving side waits for the next
+	// packet before it gives up; 0 means ReceiveTimeout.
+	ReceiveTimeout time.Duration
+}
+
+// String formats the options as "key=value" fields for a command line.
+func (o TransferOptions) String() string {
+	var fields []string
+	if o.FECBlock != 0 {
+		fields = append(fields, fmt.Sprintf("fec=%d", o.FECBlock))
+	}
+	if o.ChunkSize != 0 {
+		fields = append(fields, fmt.Sprintf("chunk=%d", o.ChunkSize))
+	}
+	return strings.Join(fields, " ")
+}
+
+func (o TransferOptions) chunkSize() int {
+	if o.ChunkSize == 0 {
+		return ChunkSize
+	}
+	return o.ChunkSize
+}
+
+func (o TransferOptions) receiveTimeout() time.Duration {
+	if o.ReceiveTimeout == 0 {
+		return ReceiveTimeout
+	}
+	return o.ReceiveTimeout
+}
+
+// ReplyOptions are the options a reply too large for one datagram is sent
+// with on stream: those of the last transfer agreed with the peer, or the
+// defaults, with the chunk size cut by what encryption adds to a packet.
+// The chunk size is also the most a reply may carry inline.
+func ReplyOptions(agreed TransferOptions, stream *Stream) TransferOptions {
+	agreed.ChunkSize = max(agreed.chunkSize()-sealOverhead(stream), MinChunkSize)
+	return agreed
+}
+
+// ParseTransferOptions reads "key=value" fields, ignoring unknown keys so
+// newer peers can propose options older ones do not know.
+func ParseTransferOptions(fields []string) (TransferOptions, error) {
+	var o TransferOptions
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "fec":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > MaxFECBlock {
+				return o, fmt.Errorf("fec block must be between 0 and %d", MaxFECBlock)
+			}
+			o.FECBlock = n
+		case "chunk":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < MinChunkSize || n > MaxChunkSize {
+				return o, fmt.Errorf("chunk size must be between %d and %d", MinChunkSize, MaxChunkSize)
+			}
+			o.ChunkSize = n
+		}
+	}
+	return o, nil
+}
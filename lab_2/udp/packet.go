@@ -0,0 +1,171 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Every datagram starts with a fixed header:
+//
+//	0      2        3     4      6             10    14       16         20
+//	| magic | version | type | flags | transfer ID | seq | length | checksum |
+//
+// All fields are big-endian. The checksum is the CRC32 (IEEE) of the header,
+// with the checksum field zeroed, followed by the payload.
+const (
+	Magic          uint16 = 0x4E53 // "NS"
+	Version        uint8  = 1
+	HeaderSize            = 20
+	MaxPayloadSize        = 1<<16 - 1
+)
+
+type PacketType uint8
+
+const (
+	TypeData PacketType = iota + 1
+	TypeAck
+	TypeNack
+	TypeEOF
+	TypeError
+	TypeCmd
+	TypeParity
+	TypeProbe
+	TypeHello
+	TypeWelcome
+	TypeHeartbeat
+	TypeGoodbye
+	TypeSealed
+)
+
+func (t PacketType) String() string {
+	switch t {
+	case TypeData:
+		return "DATA"
+	case TypeAck:
+		return "ACK"
+	case TypeNack:
+		return "NACK"
+	case TypeEOF:
+		return "EOF"
+	case TypeError:
+		return "ERROR"
+	case TypeCmd:
+		return "CMD"
+	case TypeParity:
+		return "PARITY"
+	case TypeProbe:
+		return "PROBE"
+	case TypeHello:
+		return "HELLO"
+	case TypeWelcome:
+		return "WELCOME"
+	case TypeHeartbeat:
+		return "HEARTBEAT"
+	case TypeGoodbye:
+		return "GOODBYE"
+	case TypeSealed:
+		return "SEALED"
+	default:
+		return fmt.Sprintf("TYPE(%d)", uint8(t))
+	}
+}
+
+// ErrCorrupt is returned for datagrams whose header is intact but whose
+// checksum does not match, typically bit errors on links that do not check
+// UDP checksums.
+var ErrCorrupt = errors.New("corrupted packet")
+
+const (
+	// FlagRetransmit marks a packet the sender has sent before.
+	FlagRetransmit uint16 = 1 << iota
+	// FlagNotify marks a command-channel message the server sends on its
+	// own, such as a transfer outcome, rather than as a direct reply.
+	FlagNotify
+	// FlagStream marks a reply whose body follows as a transfer on the
+	// request's stream; the payload is only its length.
+	FlagStream
+)
+
+// Packet is a decoded datagram. TransferID says which stream it belongs
+// to; CommandStream is the command channel.
+type Packet struct {
+	Type       PacketType
+	Flags      uint16
+	TransferID uint32
+	Seq        uint32
+	Payload    []byte
+}
+
+// BuildPacket encodes p with its header and checksum.
+func BuildPacket(p Packet) ([]byte, error) {
+	if len(p.Payload) > MaxPayloadSize {
+		return nil, fmt.Errorf("payload of %d bytes exceeds %d", len(p.Payload), MaxPayloadSize)
+	}
+
+	datagram := make([]byte, HeaderSize+len(p.Payload))
+	binary.BigEndian.PutUint16(datagram[0:2], Magic)
+	datagram[2] = Version
+	datagram[3] = byte(p.Type)
+	binary.BigEndian.PutUint16(datagram[4:6], p.Flags)
+	binary.BigEndian.PutUint32(datagram[6:10], p.TransferID)
+	binary.BigEndian.PutUint32(datagram[10:14], p.Seq)
+	binary.BigEndian.PutUint16(datagram[14:16], uint16(len(p.Payload)))
+	copy(datagram[HeaderSize:], p.Payload)
+	binary.BigEndian.PutUint32(datagram[16:20], crc32.ChecksumIEEE(datagram))
+	return datagram, nil
+}
+
+// ParsePacket decodes a datagram, rejecting foreign, truncated and
+// corrupted ones. The payload aliases datagram. A corrupted packet is still
+// returned alongside ErrCorrupt, but none of its fields can be trusted.
+func ParsePacket(datagram []byte) (Packet, error) {
+	if err := checkHeader(datagram); err != nil {
+		return Packet{}, err
+	}
+
+	length := int(binary.BigEndian.Uint16(datagram[14:16]))
+	if len(datagram) != HeaderSize+length {
+		return Packet{}, fmt.Errorf("payload length %d does not match datagram of %d bytes", length, len(datagram))
+	}
+
+	p := Packet{
+		Type:       PacketType(datagram[3]),
+		Flags:      binary.BigEndian.Uint16(datagram[4:6]),
+		TransferID: binary.BigEndian.Uint32(datagram[6:10]),
+		Seq:        binary.BigEndian.Uint32(datagram[10:14]),
+		Payload:    datagram[HeaderSize:],
+	}
+
+	expected := binary.BigEndian.Uint32(datagram[16:20])
+	crc := crc32.Update(0, crc32.IEEETable, datagram[:16])
+	crc = crc32.Update(crc, crc32.IEEETable, []byte{0, 0, 0, 0})
+	crc = crc32.Update(crc, crc32.IEEETable, datagram[HeaderSize:])
+	if crc != expected {
+		return p, fmt.Errorf("%w: checksum %08x, want %08x", ErrCorrupt, crc, expected)
+	}
+	return p, nil
+}
+
+// PeekTransferID reads the transfer ID of a datagram without verifying its
+// checksum, so a demultiplexer can route it cheaply.
+func PeekTransferID(datagram []byte) (uint32, bool) {
+	if checkHeader(datagram) != nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(datagram[6:10]), true
+}
+
+func checkHeader(datagram []byte) error {
+	if len(datagram) < HeaderSize {
+		return fmt.Errorf("datagram of %d bytes is shorter than the header", len(datagram))
+	}
+	if magic := binary.BigEndian.Uint16(datagram[0:2]); magic != Magic {
+		return fmt.Errorf("bad magic %04x", magic)
+	}
+	if version := datagram[2]; version != Version {
+		return fmt.Errorf("unsupported protocol version %d", version)
+	}
+	return nil
+}
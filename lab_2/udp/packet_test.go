@@ -0,0 +1,125 @@
+package udp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	packets := []Packet{
+		{Type: TypeData, TransferID: 7, Seq: 42, Payload: []byte("hello")},
+		{Type: TypeEOF, TransferID: 7, Seq: 43, Payload: []byte("EOF")},
+		{Type: TypeCmd, Flags: FlagNotify | FlagStream, Seq: 1},
+		{Type: TypeAck, Flags: FlagRetransmit, TransferID: 1<<32 - 1, Seq: 1<<32 - 1},
+		{Type: TypeData, Payload: bytes.Repeat([]byte{0xff}, MaxPayloadSize)},
+	}
+	for _, want := range packets {
+		datagram, err := BuildPacket(want)
+		if err != nil {
+			t.Fatalf("BuildPacket(%v): %v", want.Type, err)
+		}
+		if len(datagram) != HeaderSize+len(want.Payload) {
+			t.Errorf("%v: datagram is %d bytes, want %d", want.Type, len(datagram), HeaderSize+len(want.Payload))
+		}
+		got, err := ParsePacket(datagram)
+		if err != nil {
+			t.Fatalf("ParsePacket(%v): %v", want.Type, err)
+		}
+		if got.Type != want.Type || got.Flags != want.Flags || got.TransferID != want.TransferID ||
+			got.Seq != want.Seq || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("round trip of %+v gave %+v", want, got)
+		}
+		if id, ok := PeekTransferID(datagram); !ok || id != want.TransferID {
+			t.Errorf("PeekTransferID = %d, %v, want %d", id, ok, want.TransferID)
+		}
+	}
+}
+
+func TestBuildPacketTooLarge(t *testing.T) {
+	if _, err := BuildPacket(Packet{Type: TypeData, Payload: make([]byte, MaxPayloadSize+1)}); err == nil {
+		t.Error("BuildPacket accepted a payload larger than MaxPayloadSize")
+	}
+}
+
+func TestParsePacketBadCRC(t *testing.T) {
+	datagram, err := BuildPacket(Packet{Type: TypeData, TransferID: 3, Seq: 9, Payload: []byte("payload")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{3, 12, 17, HeaderSize + 2} {
+		damaged := append([]byte(nil), datagram...)
+		damaged[i] ^= 0x01
+		if _, err := ParsePacket(damaged); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("flipping a bit of byte %d: got %v, want ErrCorrupt", i, err)
+		}
+	}
+}
+
+func TestParsePacketBadHeader(t *testing.T) {
+	datagram, err := BuildPacket(Packet{Type: TypeData, Payload: []byte("payload")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	badMagic := append([]byte(nil), datagram...)
+	badMagic[0] ^= 0xff
+	badVersion := append([]byte(nil), datagram...)
+	badVersion[2] = Version + 1
+
+	tests := []struct {
+		name     string
+		datagram []byte
+	}{
+		{"empty", nil},
+		{"short header", datagram[:HeaderSize-1]},
+		{"truncated payload", datagram[:len(datagram)-1]},
+		{"trailing bytes", append(append([]byte(nil), datagram...), 0)},
+		{"bad magic", badMagic},
+		{"bad version", badVersion},
+	}
+	for _, test := range tests {
+		_, err := ParsePacket(test.datagram)
+		if err == nil {
+			t.Errorf("%s: ParsePacket accepted it", test.name)
+		}
+		if errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: got ErrCorrupt, want a header error", test.name)
+		}
+	}
+	for _, test := range tests[:2] {
+		if _, ok := PeekTransferID(test.datagram); ok {
+			t.Errorf("%s: PeekTransferID accepted it", test.name)
+		}
+	}
+}
+
+func FuzzParsePacket(f *testing.F) {
+	for _, p := range []Packet{
+		{Type: TypeData, TransferID: 1, Seq: 2, Payload: []byte("data")},
+		{Type: TypeHello, Payload: []byte("version=1 caps=fec,chunk")},
+		{Type: TypeAck, Seq: 1},
+	} {
+		datagram, err := BuildPacket(p)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(datagram)
+	}
+	f.Add([]byte{})
+	f.Add([]byte("NS"))
+
+	f.Fuzz(func(t *testing.T, datagram []byte) {
+		p, err := ParsePacket(datagram)
+		if err != nil {
+			return
+		}
+		// Whatever parses cleanly must encode back to the same bytes.
+		rebuilt, err := BuildPacket(p)
+		if err != nil {
+			t.Fatalf("BuildPacket of a parsed packet: %v", err)
+		}
+		if !bytes.Equal(rebuilt, datagram) {
+			t.Fatalf("re-encoding %x gave %x", datagram, rebuilt)
+		}
+	})
+}
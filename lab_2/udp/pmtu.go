@@ -0,0 +1,98 @@
+package udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	ProbeTimeout = 300 * time.Millisecond
+	ProbeRetries = 2
+	// FallbackMTU is assumed when probing is impossible: every IPv6 path
+	// and nearly every IPv4 path carries it.
+	FallbackMTU = 1280
+)
+
+// mtuPlateaus are the common link MTUs (RFC 1191) tried from the largest
+// down, so a path of ordinary Ethernet is found in a probe or two.
+var mtuPlateaus = []int{9000, 4352, 1500, 1492, 1280, 1006, 576}
+
+// ProbePathMTU finds the largest packet that reaches the peer without IP
+// fragmentation. With the don't-fragment bit set, a probe larger than the
+// local link fails to send and one larger than some hop on the path is
+// dropped, so the first plateau the peer echoes is the path MTU. If the
+// bit cannot be set or no probe is answered, it returns FallbackMTU with
+// the reason.
+func ProbePathMTU(stream *Stream) (int, error) {
+	if err := setDontFragment(stream.Conn); err != nil {
+		return FallbackMTU, fmt.Errorf("cannot set don't-fragment: %v", err)
+	}
+
+	overhead := ipOverhead(stream.Addr) + sealOverhead(stream)
+	for _, mtu := range mtuPlateaus {
+		if mtu-overhead < HeaderSize {
+			break
+		}
+		if probeMTU(stream, mtu, overhead) {
+			Logger.Printf("Path MTU to %s is %d", stream.Addr, mtu)
+			return mtu, nil
+		}
+	}
+	return FallbackMTU, errors.New("no probe was answered")
+}
+
+// probeMTU sends a probe filling a packet of mtu bytes and waits for the
+// peer to echo its size.
+func probeMTU(stream *Stream, mtu, overhead int) bool {
+	probe := Packet{Type: TypeProbe, Seq: uint32(mtu), Payload: make([]byte, mtu-overhead-HeaderSize)}
+	for i := 0; i < ProbeRetries; i++ {
+		if err := stream.Send(probe); err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				return false
+			}
+			Logger.Printf("Error sending %d-byte probe: %v", mtu, err)
+			continue
+		}
+
+		deadline := time.Now().Add(ProbeTimeout)
+		for {
+			reply, err := stream.Receive(deadline)
+			if errors.Is(err, ErrCorrupt) {
+				continue
+			}
+			if err != nil {
+				break
+			}
+			if reply.Type == TypeProbe && reply.Seq == uint32(mtu) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ChunkSizeForMTU is the largest chunk whose data and parity packets fit
+// in one IP packet of mtu bytes on stream.
+func ChunkSizeForMTU(mtu int, stream *Stream) int {
+	overhead := ipOverhead(stream.Addr) + sealOverhead(stream)
+	return min(max(mtu-overhead-HeaderSize-parityHeaderSize, MinChunkSize), MaxChunkSize)
+}
+
+// sealOverhead is what encryption adds to each datagram on stream.
+func sealOverhead(stream *Stream) int {
+	if stream.Sealed() {
+		return SealOverhead
+	}
+	return 0
+}
+
+// ipOverhead is the size of the IP and UDP headers in front of a datagram.
+func ipOverhead(addr *net.UDPAddr) int {
+	if addr.IP.To4() != nil {
+		return 20 + 8
+	}
+	return 40 + 8
+}
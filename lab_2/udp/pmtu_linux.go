@@ -0,0 +1,28 @@
+package udp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment turns on path MTU discovery for the socket, which sets
+// the DF bit and makes oversized sends fail with EMSGSIZE instead of
+// fragmenting. The socket may be dual-stack, so both families are set.
+func setDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var err4, err6 error
+	if err := raw.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+	}); err != nil {
+		return err
+	}
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
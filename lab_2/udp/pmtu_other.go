@@ -0,0 +1,12 @@
+//go:build !linux
+
+package udp
+
+import (
+	"errors"
+	"net"
+)
+
+func setDontFragment(conn *net.UDPConn) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,154 @@
+package udp
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Once a session is keyed, every datagram is sealed whole into another:
+//
+//	0      2        3              4         12
+//	| magic | version | TypeSealed | counter | ciphertext and tag |
+//
+// The counter is the sender's record sequence number, one per datagram
+// sent, retransmissions included, and with four zero bytes in front it is
+// the ChaCha20-Poly1305 nonce. Each direction has its own key, so counters
+// never collide. The 12-byte header is authenticated as associated data.
+const (
+	sealedHeaderSize = 12
+	SealOverhead     = sealedHeaderSize + chacha20poly1305.Overhead
+	// ReplayWindow is how far behind the newest counter a datagram may
+	// arrive and still be accepted, once.
+	ReplayWindow = 1024
+)
+
+var (
+	ErrReplayed = errors.New("replayed or too old datagram")
+	ErrForged   = errors.New("datagram failed authentication")
+)
+
+// Cipher seals and opens the datagrams of one keyed session.
+type Cipher struct {
+	send    cipher.AEAD
+	receive cipher.AEAD
+	sent    atomic.Uint64
+	window  replayWindow
+	mu      sync.Mutex
+}
+
+func newCipher(sendKey, receiveKey []byte) (*Cipher, error) {
+	send, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	receive, err := chacha20poly1305.New(receiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{send: send, receive: receive}, nil
+}
+
+// Seal encrypts a datagram under the next counter.
+func (c *Cipher) Seal(datagram []byte) []byte {
+	sealed := make([]byte, sealedHeaderSize, sealedHeaderSize+len(datagram)+chacha20poly1305.Overhead)
+	binary.BigEndian.PutUint16(sealed[0:2], Magic)
+	sealed[2] = Version
+	sealed[3] = byte(TypeSealed)
+	counter := c.sent.Add(1)
+	binary.BigEndian.PutUint64(sealed[4:12], counter)
+	return c.send.Seal(sealed, nonce(counter), datagram, sealed[:sealedHeaderSize])
+}
+
+// Open authenticates and decrypts a sealed datagram, refusing one whose
+// counter has been seen before or has fallen out of the replay window.
+func (c *Cipher) Open(sealed []byte) ([]byte, error) {
+	if !isSealed(sealed) || len(sealed) < SealOverhead {
+		return nil, ErrForged
+	}
+	counter := binary.BigEndian.Uint64(sealed[4:12])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.window.fresh(counter) {
+		return nil, ErrReplayed
+	}
+	datagram, err := c.receive.Open(nil, nonce(counter), sealed[sealedHeaderSize:], sealed[:sealedHeaderSize])
+	if err != nil {
+		return nil, ErrForged
+	}
+	// Only an authentic datagram may move the window.
+	c.window.mark(counter)
+	return datagram, nil
+}
+
+func nonce(counter uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+func isSealed(datagram []byte) bool {
+	return len(datagram) >= sealedHeaderSize && checkMagic(datagram) && PacketType(datagram[3]) == TypeSealed
+}
+
+// isHello reports whether datagram is a plain HELLO, the one packet
+// accepted unsealed on a session that requires encryption.
+func isHello(datagram []byte) bool {
+	return checkHeader(datagram) == nil && PacketType(datagram[3]) == TypeHello
+}
+
+func checkMagic(datagram []byte) bool {
+	return binary.BigEndian.Uint16(datagram[0:2]) == Magic && datagram[2] == Version
+}
+
+// replayWindow remembers which of the last ReplayWindow counters have
+// been seen, as bits in a ring indexed by counter.
+type replayWindow struct {
+	newest uint64
+	seen   [ReplayWindow / 64]uint64
+}
+
+func (w *replayWindow) fresh(counter uint64) bool {
+	switch {
+	case counter == 0:
+		return false
+	case counter > w.newest:
+		return true
+	case w.newest-counter >= ReplayWindow:
+		return false
+	}
+	return !w.bit(counter)
+}
+
+func (w *replayWindow) mark(counter uint64) {
+	if counter > w.newest {
+		if counter-w.newest >= ReplayWindow {
+			clear(w.seen[:])
+		} else {
+			for skipped := w.newest + 1; skipped < counter; skipped++ {
+				w.set(skipped, false)
+			}
+		}
+		w.newest = counter
+	}
+	w.set(counter, true)
+}
+
+func (w *replayWindow) bit(counter uint64) bool {
+	i := counter % ReplayWindow
+	return w.seen[i/64]&(1<<(i%64)) != 0
+}
+
+func (w *replayWindow) set(counter uint64, seen bool) {
+	i := counter % ReplayWindow
+	if seen {
+		w.seen[i/64] |= 1 << (i % 64)
+	} else {
+		w.seen[i/64] &^= 1 << (i % 64)
+	}
+}
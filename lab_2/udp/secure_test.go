@@ -0,0 +1,196 @@
+package udp
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	steps := []struct {
+		counter uint64
+		fresh   bool
+	}{
+		{0, false}, // counters start at 1
+		{1, true},
+		{1, false},
+		{5, true},
+		{3, true}, // late but inside the window
+		{3, false},
+		{2, true},
+		{5, false},
+		{ReplayWindow + 4, true},
+		{6, true},  // still inside the window
+		{4, false}, // fallen out of it
+		{ReplayWindow + 4, false},
+		{5 * ReplayWindow, true}, // a jump past the whole window
+		{4 * ReplayWindow, false},
+		{4*ReplayWindow + 1, true},
+		{4*ReplayWindow + 1, false},
+	}
+	for i, step := range steps {
+		if got := w.fresh(step.counter); got != step.fresh {
+			t.Fatalf("step %d: fresh(%d) = %v, want %v", i, step.counter, got, step.fresh)
+		}
+		if step.fresh {
+			w.mark(step.counter)
+		}
+	}
+}
+
+func testCiphers(t *testing.T) (client, server *Cipher) {
+	t.Helper()
+	toServer, toClient := make([]byte, 32), make([]byte, 32)
+	rand.Read(toServer)
+	rand.Read(toClient)
+	client, err := newCipher(toServer, toClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = newCipher(toClient, toServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestCipherOpen(t *testing.T) {
+	client, server := testCiphers(t)
+	first := client.Seal([]byte("first"))
+	second := client.Seal([]byte("second"))
+
+	// Out of order is fine, once.
+	for _, sealed := range [][]byte{second, first} {
+		if _, err := server.Open(sealed); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+	}
+	if _, err := server.Open(first); !errors.Is(err, ErrReplayed) {
+		t.Errorf("Open of a replay = %v, want ErrReplayed", err)
+	}
+
+	// A datagram sealed for the other direction does not open.
+	if _, err := client.Open(client.Seal([]byte("loop"))); !errors.Is(err, ErrForged) {
+		t.Errorf("Open of an own datagram = %v, want ErrForged", err)
+	}
+
+	// Neither does one with its counter or its ciphertext changed, and
+	// such a datagram leaves the window as it was.
+	third := client.Seal([]byte("third"))
+	for _, offset := range []int{11, sealedHeaderSize, len(third) - 1} {
+		forged := bytes.Clone(third)
+		forged[offset] ^= 1
+		if _, err := server.Open(forged); !errors.Is(err, ErrForged) {
+			t.Errorf("Open with byte %d changed = %v, want ErrForged", offset, err)
+		}
+	}
+	if datagram, err := server.Open(third); err != nil || string(datagram) != "third" {
+		t.Errorf("Open after forgeries = %q, %v, want \"third\"", datagram, err)
+	}
+}
+
+// exchangeKeys runs the handshake between a server with static and psk
+// and a client with security, letting tamper change the WELCOME on the
+// way. It returns both ciphers and the client's error, if any.
+func exchangeKeys(t *testing.T, static *ecdh.PrivateKey, psk string, security *Security, tamper func(welcome []byte) []byte) (client, server *Cipher, err error) {
+	t.Helper()
+	kx, err := newKeyExchange(security)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := LocalHello()
+	local.Key = kx.ephemeral.PublicKey().Bytes()
+	helloPayload := []byte(local.String())
+	hello, err := ParseHello(helloPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	welcomePayload, server, err := AcceptKeyExchange(static, psk, helloPayload, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		welcomePayload = tamper(welcomePayload)
+	}
+	welcome, err := ParseHello(welcomePayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = kx.finish("127.0.0.1:8000", helloPayload, welcomePayload, welcome)
+	return client, server, err
+}
+
+func TestKeyExchange(t *testing.T) {
+	static, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := ServerTrust{Pin: strings.ToUpper(PublicKey(static))}
+
+	for _, psk := range []string{"", "secret"} {
+		client, server, err := exchangeKeys(t, static, psk, &Security{Trust: pinned, PSK: psk}, nil)
+		if err != nil {
+			t.Fatalf("psk %q: %v", psk, err)
+		}
+		if datagram, err := server.Open(client.Seal([]byte("up"))); err != nil || string(datagram) != "up" {
+			t.Errorf("psk %q: server opened %q, %v", psk, datagram, err)
+		}
+		if datagram, err := client.Open(server.Seal([]byte("down"))); err != nil || string(datagram) != "down" {
+			t.Errorf("psk %q: client opened %q, %v", psk, datagram, err)
+		}
+	}
+
+	refused := []struct {
+		name     string
+		static   *ecdh.PrivateKey
+		psk      string
+		security Security
+		tamper   func([]byte) []byte
+	}{
+		{name: "other server key", static: other, security: Security{Trust: pinned}},
+		{name: "wrong psk", static: static, psk: "secret", security: Security{Trust: pinned, PSK: "guess"}},
+		{name: "missing psk", static: static, psk: "secret", security: Security{Trust: pinned}},
+		{name: "altered welcome", static: static, security: Security{Trust: pinned}, tamper: func(welcome []byte) []byte {
+			return bytes.Replace(welcome, []byte("caps="), []byte("caps=extra,"), 1)
+		}},
+		{name: "no encryption", static: static, security: Security{Trust: pinned}, tamper: func([]byte) []byte {
+			return []byte(LocalHello().String())
+		}},
+	}
+	for _, c := range refused {
+		if _, _, err := exchangeKeys(t, c.static, c.psk, &c.security, c.tamper); err == nil {
+			t.Errorf("%s: key exchange succeeded", c.name)
+		}
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	static, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	security := &Security{Trust: ServerTrust{KnownHosts: filepath.Join(t.TempDir(), "known_hosts")}}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := exchangeKeys(t, static, "", security, nil); err != nil {
+			t.Fatalf("exchange %d with the first key seen: %v", i+1, err)
+		}
+	}
+	if _, _, err := exchangeKeys(t, other, "", security, nil); err == nil {
+		t.Fatal("a changed server key was accepted")
+	}
+}
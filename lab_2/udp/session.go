@@ -0,0 +1,149 @@
+package udp
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeartbeatStream carries heartbeats and goodbyes, which the mux
+	// handles itself.
+	HeartbeatStream uint32 = math.MaxUint32
+
+	HeartbeatInterval  = 5 * time.Second
+	DeadPeerTimeout    = 3 * HeartbeatInterval
+	SessionIdleTimeout = 6 * HeartbeatInterval
+)
+
+// Capabilities are the protocol features this build supports, exchanged
+// in the handshake so each side only uses what the other understands.
+var Capabilities = []string{"fec", "chunk", "probe", "stream-replies"}
+
+// Hello is the payload of HELLO and WELCOME packets. Key, Static and
+// Proof, set when the session is encrypted, carry the key exchange.
+type Hello struct {
+	Version      int
+	Capabilities []string
+	Key          []byte
+	Static       []byte
+	Proof        []byte
+}
+
+func (h Hello) String() string {
+	s := fmt.Sprintf("version=%d caps=%s", h.Version, strings.Join(h.Capabilities, ","))
+	for _, field := range []struct {
+		name  string
+		value []byte
+	}{{"key", h.Key}, {"static", h.Static}, {"proof", h.Proof}} {
+		if field.value != nil {
+			s += " " + field.name + "=" + hex.EncodeToString(field.value)
+		}
+	}
+	return s
+}
+
+// Supports reports whether the peer announced capability.
+func (h Hello) Supports(capability string) bool {
+	return slices.Contains(h.Capabilities, capability)
+}
+
+func ParseHello(payload []byte) (Hello, error) {
+	var h Hello
+	for _, field := range strings.Fields(string(payload)) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "version":
+			version, err := strconv.Atoi(value)
+			if err != nil {
+				return h, fmt.Errorf("bad version %q", value)
+			}
+			h.Version = version
+		case "caps":
+			if value != "" {
+				h.Capabilities = strings.Split(value, ",")
+			}
+		case "key", "static", "proof":
+			decoded, err := hex.DecodeString(value)
+			if err != nil {
+				return h, fmt.Errorf("bad %s %q", key, value)
+			}
+			switch key {
+			case "key":
+				h.Key = decoded
+			case "static":
+				h.Static = decoded
+			case "proof":
+				h.Proof = decoded
+			}
+		}
+	}
+	if h.Version == 0 {
+		return h, errors.New("missing version")
+	}
+	return h, nil
+}
+
+// LocalHello describes this side of the connection.
+func LocalHello() Hello {
+	return Hello{Version: int(Version), Capabilities: Capabilities}
+}
+
+// Handshake opens a session: it sends HELLO on the command stream until
+// the server answers WELCOME with its own version and capabilities, or
+// refuses with an ERROR. With security set, the two also exchange keys,
+// and the session is encrypted from then on.
+func Handshake(stream *Stream, timeout time.Duration, security *Security) (Hello, error) {
+	local := LocalHello()
+	var kx *keyExchange
+	if security != nil {
+		var err error
+		if kx, err = newKeyExchange(security); err != nil {
+			return Hello{}, err
+		}
+		local.Key = kx.ephemeral.PublicKey().Bytes()
+	}
+	hello := Packet{Type: TypeHello, Payload: []byte(local.String())}
+	for i := 0; i < MaxRetries; i++ {
+		if err := stream.Send(hello); err != nil {
+			return Hello{}, fmt.Errorf("error sending hello: %v", err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		for {
+			reply, err := stream.Receive(deadline)
+			if errors.Is(err, ErrCorrupt) {
+				continue
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return Hello{}, err
+			}
+
+			switch reply.Type {
+			case TypeWelcome:
+				welcome, err := ParseHello(reply.Payload)
+				if err != nil || kx == nil {
+					return welcome, err
+				}
+				cipher, err := kx.finish(stream.Addr.String(), hello.Payload, reply.Payload, welcome)
+				if err != nil {
+					return Hello{}, err
+				}
+				stream.mux.Secure(cipher)
+				return welcome, nil
+			case TypeError:
+				return Hello{}, fmt.Errorf("server refused session: %s", reply.Payload)
+			}
+		}
+	}
+	return Hello{}, errors.New("server is not responding")
+}
@@ -0,0 +1,280 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CommandStream is the stream ID of the command channel. File transfers get
+// their own non-zero IDs from the server.
+const CommandStream uint32 = 0
+
+// Stream is one conversation with a peer over a shared UDP socket. Every
+// packet carries the stream ID as its transfer ID, so commands and the
+// packets of different transfers can no longer be mistaken for one another.
+type Stream struct {
+	ID        uint32
+	Conn      *net.UDPConn
+	Addr      *net.UDPAddr
+	Corrupted int // datagrams dropped for a bad checksum
+	inbox     <-chan []byte
+	mux       *Mux
+}
+
+// Send stamps p with the stream ID and writes it to the peer, sealed if
+// the session is keyed. HELLO and WELCOME carry the key exchange and so
+// always go in the clear.
+func (s *Stream) Send(p Packet) error {
+	p.TransferID = s.ID
+	datagram, err := BuildPacket(p)
+	if err != nil {
+		return err
+	}
+	if cipher := s.cipher(); cipher != nil && p.Type != TypeHello && p.Type != TypeWelcome {
+		datagram = cipher.Seal(datagram)
+	}
+	_, err = s.Conn.WriteToUDP(datagram, s.Addr)
+	return err
+}
+
+// Sealed reports whether the stream's packets are encrypted.
+func (s *Stream) Sealed() bool {
+	return s.cipher() != nil
+}
+
+func (s *Stream) cipher() *Cipher {
+	if s.mux == nil {
+		return nil
+	}
+	return s.mux.cipher.Load()
+}
+
+// Receive waits until deadline, or forever if it is zero, for the next
+// valid packet on this stream, dropping datagrams that fail to decode. On
+// timeout the error matches os.ErrDeadlineExceeded, and once the stream is
+// closed it is net.ErrClosed. A corrupted packet is counted and returned
+// with an error matching ErrCorrupt so the caller can ask for it again.
+func (s *Stream) Receive(deadline time.Time) (Packet, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		var datagram []byte
+		select {
+		case d, ok := <-s.inbox:
+			if !ok {
+				return Packet{}, net.ErrClosed
+			}
+			datagram = d
+		case <-timeout:
+			return Packet{}, os.ErrDeadlineExceeded
+		}
+
+		p, err := ParsePacket(datagram)
+		if errors.Is(err, ErrCorrupt) {
+			s.Corrupted++
+			Logger.Printf("Dropping corrupted packet on stream %d: %v", s.ID, err)
+			return p, err
+		}
+		if err != nil {
+			Logger.Printf("Dropping datagram on stream %d: %v", s.ID, err)
+			continue
+		}
+		if p.TransferID != s.ID {
+			continue
+		}
+		return p, nil
+	}
+}
+
+// Mux routes the datagrams of one peer to its streams by transfer ID.
+// Datagrams for unknown streams, or for streams whose inbox is full, are
+// dropped as the network might have. Every datagram counts as a sign of
+// life from the peer; heartbeats are handled by the mux itself and, with
+// EchoHeartbeats set, answered. A GOODBYE from the peer, sent when it is
+// shutting down, is passed to OnGoodbye.
+//
+// Once Secure has keyed the mux, datagrams are sealed on the way out and
+// opened on the way in, and plain ones are dropped but for HELLO. With
+// RequireSecure set, nothing but HELLO is taken before then either. Only
+// datagrams that pass count as signs of life.
+type Mux struct {
+	Conn           *net.UDPConn
+	Addr           *net.UDPAddr
+	EchoHeartbeats bool
+	RequireSecure  bool
+	OnGoodbye      func(reason string)
+	inboxes        map[uint32]chan []byte
+	lastHeard      atomic.Int64
+	leaving        atomic.Pointer[string]
+	cipher         atomic.Pointer[Cipher]
+	mu             sync.Mutex
+}
+
+func NewMux(conn *net.UDPConn, addr *net.UDPAddr) *Mux {
+	m := &Mux{Conn: conn, Addr: addr, inboxes: make(map[uint32]chan []byte)}
+	m.lastHeard.Store(time.Now().UnixNano())
+	return m
+}
+
+// Secure keys the session: from now on every datagram is encrypted.
+func (m *Mux) Secure(cipher *Cipher) {
+	m.cipher.Store(cipher)
+}
+
+// Secured reports whether the session has been keyed.
+func (m *Mux) Secured() bool {
+	return m.cipher.Load() != nil
+}
+
+// LastHeard returns when the peer last sent anything.
+func (m *Mux) LastHeard() time.Time {
+	return time.Unix(0, m.lastHeard.Load())
+}
+
+// Heartbeat tells the peer this side is still there.
+func (m *Mux) Heartbeat() error {
+	heartbeat := Stream{ID: HeartbeatStream, Conn: m.Conn, Addr: m.Addr, mux: m}
+	return heartbeat.Send(Packet{Type: TypeHeartbeat})
+}
+
+// Leave tells the peer this side is going away. The GOODBYE may be lost,
+// so from now on it is also the answer to the peer's heartbeats.
+func (m *Mux) Leave(reason string) error {
+	m.leaving.Store(&reason)
+	return m.goodbye(reason)
+}
+
+func (m *Mux) goodbye(reason string) error {
+	goodbye := Stream{ID: HeartbeatStream, Conn: m.Conn, Addr: m.Addr, mux: m}
+	return goodbye.Send(Packet{Type: TypeGoodbye, Payload: []byte(reason)})
+}
+
+// Open registers a stream that buffers up to queue datagrams.
+func (m *Mux) Open(id uint32, queue int) *Stream {
+	inbox := make(chan []byte, queue)
+	m.mu.Lock()
+	m.inboxes[id] = inbox
+	m.mu.Unlock()
+	return &Stream{ID: id, Conn: m.Conn, Addr: m.Addr, inbox: inbox, mux: m}
+}
+
+// Close unregisters a stream; its pending Receive returns net.ErrClosed.
+func (m *Mux) Close(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if inbox, ok := m.inboxes[id]; ok {
+		delete(m.inboxes, id)
+		close(inbox)
+	}
+}
+
+// CloseAll unregisters every stream.
+func (m *Mux) CloseAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, inbox := range m.inboxes {
+		delete(m.inboxes, id)
+		close(inbox)
+	}
+}
+
+// Deliver hands a datagram to the stream it is addressed to. The mux keeps
+// the slice, so callers must not reuse it.
+func (m *Mux) Deliver(datagram []byte) {
+	datagram, authentic := m.open(datagram)
+	if datagram == nil {
+		return
+	}
+	id, ok := PeekTransferID(datagram)
+	if !ok {
+		return
+	}
+	if authentic {
+		m.lastHeard.Store(time.Now().UnixNano())
+	}
+	if id == HeartbeatStream {
+		m.control(datagram)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inbox, ok := m.inboxes[id]
+	if !ok {
+		return
+	}
+	select {
+	case inbox <- datagram:
+	default:
+	}
+}
+
+// open unseals a datagram on a keyed mux. It returns nil for one to drop,
+// and whether the datagram is one the peer can be trusted to have sent.
+func (m *Mux) open(datagram []byte) ([]byte, bool) {
+	cipher := m.cipher.Load()
+	switch {
+	case cipher != nil && isSealed(datagram):
+		opened, err := cipher.Open(datagram)
+		if err != nil {
+			Logger.Printf("Dropping sealed datagram from %s: %v", m.Addr, err)
+			return nil, false
+		}
+		return opened, true
+	case cipher != nil || m.RequireSecure:
+		if isHello(datagram) {
+			return datagram, false
+		}
+		return nil, false
+	}
+	return datagram, true
+}
+
+// control handles a packet on the heartbeat stream.
+func (m *Mux) control(datagram []byte) {
+	p, err := ParsePacket(datagram)
+	if err != nil {
+		return
+	}
+	switch p.Type {
+	case TypeHeartbeat:
+		if reason := m.leaving.Load(); reason != nil {
+			m.goodbye(*reason)
+		} else if m.EchoHeartbeats {
+			m.Heartbeat()
+		}
+	case TypeGoodbye:
+		if m.OnGoodbye != nil {
+			m.OnGoodbye(string(p.Payload))
+		}
+	}
+}
+
+// Serve reads the socket until it is closed, delivering datagrams from the
+// peer. It is for sockets that talk to a single peer, such as a client's.
+func (m *Mux) Serve() {
+	buffer := make([]byte, MaxPacketSize)
+	for {
+		n, remote, err := m.Conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			Logger.Printf("Error reading from UDP: %v", err)
+			continue
+		}
+		if remote.String() != m.Addr.String() {
+			continue
+		}
+		m.Deliver(append([]byte(nil), buffer[:n]...))
+	}
+}
@@ -2,10 +2,14 @@ package udp
 
 import (
 	"bytes"
-	"encoding/binary"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"log"
-	"net"
 	"os"
 	"strings"
 	"time"
@@ -15,59 +19,143 @@ const (
 	Port          = 8000
 	BufferSize    = 1024 * 64
 	MaxPacketSize = 1024 * 128
-	ChunkSize     = 8192
-	AckTimeout    = 2 * time.Second
-	WindowSize    = 5
+	ChunkSize     = 1448 // fills a 1500-byte IPv4 packet, parity included
+	MinChunkSize  = 256
+	MaxChunkSize  = MaxPayloadSize - parityHeaderSize
+	WindowSize    = 32
 	MaxRetries    = 5
 )
 
+// AckTimeout is the initial retransmission timeout. SetAckTimeout changes
+// it along with LingerTimeout, which is kept at twice its value.
+var (
+	AckTimeout    = 2 * time.Second
+	LingerTimeout = 2 * AckTimeout
+)
+
+func SetAckTimeout(timeout time.Duration) {
+	AckTimeout = timeout
+	LingerTimeout = 2 * timeout
+}
+
+// HashAlgorithm is the checksum the sender puts into the EOF packet.
+var HashAlgorithm = "sha256"
+
 var Logger *log.Logger
 
 func init() {
 	Logger = log.New(os.Stdout, "[UDP] ", log.LstdFlags|log.Lmicroseconds)
 }
 
-func BuildPacket(seq uint32, data []byte) []byte {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, seq)
-	buf.Write(data)
-	return buf.Bytes()
-}
+// SendCommandWithResponse sends cmd as request id and waits for the reply
+// carrying the same id, resending on timeout. The server runs a request
+// once and answers retries from its cache, and replies to other requests
+// that arrive late are skipped. A reply too large for one datagram is
+// received on replies, the caller's stream for the request, with opts.
+func SendCommandWithResponse(stream *Stream, replies *Stream, id uint32, cmd string, timeout time.Duration, opts TransferOptions) (string, error) {
+	for i := 0; i < MaxRetries; i++ {
+		Logger.Printf("Sending command %d: %q (attempt %d)", id, Redact(cmd), i+1)
+		if err := stream.Send(Packet{Type: TypeCmd, Seq: id, Payload: []byte(cmd)}); err != nil {
+			Logger.Printf("Command send error: %v", err)
+			continue
+		}
 
-func ParsePacket(packet []byte) (uint32, []byte) {
-	if len(packet) < 4 {
-		return 0, nil
+		p, err := awaitReply(stream, id, time.Now().Add(timeout), false)
+		if err != nil {
+			Logger.Printf("Command response error: %v", err)
+			continue
+		}
+
+		if p.Flags&FlagStream != 0 {
+			Logger.Printf("Response to %d is %s bytes, receiving it on its stream", id, p.Payload)
+			body, err := DownloadBytes(replies, opts)
+			if err != nil {
+				return "", fmt.Errorf("error receiving response: %v", err)
+			}
+			return string(body), nil
+		}
+
+		response := string(p.Payload)
+		Logger.Printf("Received response to %d: %q", id, response)
+		return response, nil
 	}
-	seq := binary.BigEndian.Uint32(packet[:4])
-	return seq, packet[4:]
+
+	return "", fmt.Errorf("max retries (%d) exceeded for command %q", MaxRetries, Redact(cmd))
 }
 
-func SendCommandWithResponse(conn *net.UDPConn, addr *net.UDPAddr, cmd string, timeout time.Duration) (string, error) {
-	buffer := make([]byte, MaxPacketSize)
+// Redact hides the password of a login command, for logging it.
+func Redact(cmd string) string {
+	parts := strings.Fields(cmd)
+	if len(parts) > 2 && strings.ToLower(parts[0]) == "login" {
+		return parts[0] + " " + parts[1] + " ***"
+	}
+	return cmd
+}
 
+// AwaitNotification waits for the server's notification about request id,
+// such as the outcome of the transfer it started. If none arrives within
+// timeout it repeats the request, which the server answers from its cache
+// with the notification once it has been sent.
+func AwaitNotification(stream *Stream, id uint32, cmd string, timeout time.Duration) (string, error) {
 	for i := 0; i < MaxRetries; i++ {
-		Logger.Printf("Sending command: %q (attempt %d)", cmd, i+1)
-		if _, err := conn.WriteToUDP([]byte(cmd), addr); err != nil {
+		p, err := awaitReply(stream, id, time.Now().Add(timeout), true)
+		if err == nil {
+			Logger.Printf("Received notification for %d: %q", id, p.Payload)
+			return string(p.Payload), nil
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return "", err
+		}
+
+		Logger.Printf("No notification for %d yet, asking again", id)
+		if err := stream.Send(Packet{Type: TypeCmd, Seq: id, Payload: []byte(cmd)}); err != nil {
 			Logger.Printf("Command send error: %v", err)
-			continue
 		}
+	}
 
-		conn.SetReadDeadline(time.Now().Add(timeout))
-		n, _, err := conn.ReadFromUDP(buffer)
+	return "", fmt.Errorf("no outcome received for command %q", cmd)
+}
+
+// awaitReply skips command-channel packets until one for request id
+// arrives, with or without FlagNotify as asked.
+func awaitReply(stream *Stream, id uint32, deadline time.Time, notify bool) (Packet, error) {
+	for {
+		p, err := stream.Receive(deadline)
+		if errors.Is(err, ErrCorrupt) {
+			continue
+		}
 		if err != nil {
-			Logger.Printf("Command response error: %v", err)
+			return Packet{}, err
+		}
+		if p.Type != TypeCmd || p.Seq != id || (p.Flags&FlagNotify != 0) != notify {
+			Logger.Printf("Skipping stale %v packet for request %d", p.Type, p.Seq)
 			continue
 		}
-
-		response := string(buffer[:n])
-		Logger.Printf("Received response: %q", response)
-		return response, nil
+		return p, nil
 	}
+}
+
+// windowSlot is one packet in flight in the sender's window.
+type windowSlot struct {
+	packet    Packet
+	size      int
+	sentAt    time.Time
+	retries   int
+	acked     bool
+	laterAcks int
+}
 
-	return "", fmt.Errorf("max retries (%d) exceeded for command %q", MaxRetries, cmd)
+// transferStats is what a transfer cost, for its summary line.
+type transferStats struct {
+	bytes         int64
+	retransmitted int
+	parity        int
+	recovered     int
+	nacks         int
 }
 
-func Upload(filePath string, conn *net.UDPConn, addr *net.UDPAddr) error {
+// Upload sends the file over stream and prints a summary.
+func Upload(filePath string, stream *Stream, opts TransferOptions) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("error opening file: %v", err)
@@ -75,117 +163,502 @@ func Upload(filePath string, conn *net.UDPConn, addr *net.UDPAddr) error {
 	defer file.Close()
 
 	fileInfo, _ := file.Stat()
-	totalSize := fileInfo.Size()
-	buffer := make([]byte, ChunkSize)
-	seq := uint32(0)
-	var sent int64
+	stats, err := sendData(file, fileInfo.Size(), stream, opts, printProgress)
+	if err != nil {
+		return err
+	}
 
-	for {
-		n, err := file.Read(buffer)
-		if err != nil {
-			break
+	fmt.Printf("\nUpload complete (%d bytes, %d retransmissions, %d parity packets, %d corrupted packets dropped)\n",
+		stats.bytes, stats.retransmitted, stats.parity, stream.Corrupted)
+	return nil
+}
+
+// UploadBytes sends data over stream, for replies too large for one
+// datagram. opts are those last agreed with the peer, see ReplyOptions.
+func UploadBytes(data []byte, stream *Stream, opts TransferOptions) error {
+	_, err := sendData(bytes.NewReader(data), int64(len(data)), stream, opts, nil)
+	return err
+}
+
+// sendData sends r with selective repeat: packets are ACKed and
+// retransmitted on their own timers, and how many are in flight is set by
+// the congestion window, capped at WindowSize. The EOF packet travels in
+// the window as the last sequence number. With opts.FECBlock set, a parity
+// packet follows every block of that many data packets. progress, if set,
+// is called as data is acknowledged.
+func sendData(r io.Reader, totalSize int64, stream *Stream, opts TransferOptions, progress func(current, total int64)) (transferStats, error) {
+	var stats transferStats
+
+	hasher, err := NewHash(HashAlgorithm)
+	if err != nil {
+		return stats, err
+	}
+
+	window := make(map[uint32]*windowSlot)
+	base, nextSeq := uint32(0), uint32(0)
+	eofQueued := false
+	cc := newCongestionControl()
+
+	var fec *parityEncoder
+	if opts.FECBlock > 0 {
+		fec = newParityEncoder(opts.FECBlock, opts.chunkSize())
+	}
+	sendParity := func(parity *Packet) {
+		if parity == nil {
+			return
+		}
+		Logger.Printf("Sending parity packet for block %d", parity.Seq)
+		if err := stream.Send(*parity); err != nil {
+			Logger.Printf("Error sending parity packet %d: %v", parity.Seq, err)
 		}
+		stats.parity++
+	}
 
-		packet := BuildPacket(seq, buffer[:n])
-	retry:
-		for i := 0; i < MaxRetries; i++ {
-			Logger.Printf("Sending packet %d (%d bytes)", seq, n)
-			if _, err := conn.WriteToUDP(packet, addr); err != nil {
-				Logger.Printf("Error sending packet %d: %v", seq, err)
-				continue
+	for !eofQueued || base < nextSeq {
+		for !eofQueued && nextSeq < base+cc.window() {
+			buffer := make([]byte, opts.chunkSize())
+			n, err := io.ReadFull(r, buffer)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				err = fmt.Errorf("error reading file: %v", err)
+				sendError(stream, err)
+				return stats, err
 			}
 
-			conn.SetReadDeadline(time.Now().Add(AckTimeout))
-			ackBuf := make([]byte, 4)
-			n, _, err := conn.ReadFromUDP(ackBuf)
-			if err != nil {
-				Logger.Printf("Ack timeout for packet %d, retrying...", seq)
-				continue
+			var packet Packet
+			var parity *Packet
+			if n == 0 {
+				// Send EOF with the checksum of everything sent
+				checksum := HashAlgorithm + ":" + hex.EncodeToString(hasher.Sum(nil))
+				packet = Packet{Type: TypeEOF, Seq: nextSeq, Payload: []byte(checksum)}
+				if fec != nil {
+					sendParity(fec.flush())
+				}
+				eofQueued = true
+				Logger.Printf("Sending EOF packet %d", nextSeq)
+			} else {
+				hasher.Write(buffer[:n])
+				packet = Packet{Type: TypeData, Seq: nextSeq, Payload: buffer[:n]}
+				if fec != nil {
+					parity = fec.add(nextSeq, buffer[:n])
+				}
+				Logger.Printf("Sending packet %d (%d bytes)", nextSeq, n)
+			}
+
+			slot := &windowSlot{packet: packet, size: n, sentAt: time.Now()}
+			window[nextSeq] = slot
+			if err := stream.Send(packet); err != nil {
+				Logger.Printf("Error sending packet %d: %v", nextSeq, err)
+			}
+			sendParity(parity)
+			nextSeq++
+		}
+
+		ack, err := stream.Receive(earliestTimeout(window, base, nextSeq, cc.rto))
+		if errors.Is(err, ErrCorrupt) {
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return stats, fmt.Errorf("error reading ack: %v", err)
+			}
+			if err := retransmitExpired(stream, window, base, nextSeq, cc); err != nil {
+				return stats, err
 			}
+			continue
+		}
+
+		switch ack.Type {
+		case TypeAck:
+		case TypeNack:
+			resendNacked(stream, window, base, ack.Seq, nextSeq, cc)
+			continue
+		case TypeError:
+			return stats, fmt.Errorf("receiver aborted: %s", ack.Payload)
+		default:
+			continue
+		}
 
-			if n >= 4 {
-				ackSeq := binary.BigEndian.Uint32(ackBuf[:4])
-				if ackSeq == seq {
-					sent += int64(n)
-					printProgress(sent, totalSize)
-					seq++
-					break retry
+		ackSeq := ack.Seq
+		slot, ok := window[ackSeq]
+		if !ok || slot.acked {
+			continue
+		}
+		slot.acked = true
+		if slot.retries == 0 {
+			cc.sampleRTT(time.Since(slot.sentAt))
+		}
+		cc.onAck()
+		stats.bytes += int64(slot.size)
+		if progress != nil {
+			progress(stats.bytes, totalSize)
+		}
+
+		// The receiver only ACKs EOF once it holds every packet before it,
+		// so packets whose own ACK was lost count as delivered too.
+		if eofQueued && ackSeq == nextSeq-1 {
+			for seq := base; seq < ackSeq; seq++ {
+				if !window[seq].acked {
+					stats.bytes += int64(window[seq].size)
 				}
 			}
+			if progress != nil {
+				progress(stats.bytes, totalSize)
+			}
+			break
 		}
+		for base < nextSeq && window[base].acked {
+			stats.retransmitted += window[base].retries
+			delete(window, base)
+			base++
+		}
+		fastRetransmit(stream, window, base, ackSeq, nextSeq, cc)
 	}
 
-	// Send EOF
-	eof := BuildPacket(seq, []byte("EOF"))
-	Logger.Printf("Sending EOF packet")
-	conn.WriteToUDP(eof, addr)
+	for _, slot := range window {
+		stats.retransmitted += slot.retries
+	}
+	return stats, nil
+}
 
-	fmt.Println("\nUpload complete")
+// earliestTimeout returns when the oldest unacknowledged packet in the
+// window times out.
+func earliestTimeout(window map[uint32]*windowSlot, base, nextSeq uint32, rto time.Duration) time.Time {
+	deadline := time.Now().Add(rto)
+	for seq := base; seq < nextSeq; seq++ {
+		slot := window[seq]
+		if !slot.acked && slot.sentAt.Add(rto).Before(deadline) {
+			deadline = slot.sentAt.Add(rto)
+		}
+	}
+	return deadline
+}
+
+// retransmitExpired resends every unacknowledged packet whose timer ran
+// out and gives up once a packet has used MaxPacketRetries retransmissions.
+// Like TCP's single retransmission timer, only the oldest packet timing
+// out counts as a loss event for the congestion window.
+func retransmitExpired(stream *Stream, window map[uint32]*windowSlot, base, nextSeq uint32, cc *congestionControl) error {
+	now := time.Now()
+	rto := cc.rto
+	lossEvent := false
+	for seq := base; seq < nextSeq; seq++ {
+		slot := window[seq]
+		if slot.acked || now.Before(slot.sentAt.Add(rto)) {
+			continue
+		}
+		if slot.retries >= MaxPacketRetries {
+			return fmt.Errorf("packet %d not acknowledged after %d retries", seq, MaxPacketRetries)
+		}
+		slot.retries++
+		slot.sentAt = now
+		slot.packet.Flags |= FlagRetransmit
+		lossEvent = lossEvent || seq == base
+		Logger.Printf("Ack timeout for packet %d, retransmitting (retry %d, rto %v)", seq, slot.retries, rto)
+		if err := stream.Send(slot.packet); err != nil {
+			Logger.Printf("Error sending packet %d: %v", seq, err)
+		}
+	}
+	if lossEvent {
+		cc.onTimeout(nextSeq)
+	}
 	return nil
 }
 
-func Download(savePath string, conn *net.UDPConn, addr *net.UDPAddr) error {
-	file, err := os.Create(savePath)
-	if err != nil {
-		return fmt.Errorf("error creating file: %v", err)
+// fastRetransmit resends a packet as soon as DupAckLimit later packets
+// have been ACKed past it, without waiting for its timer.
+func fastRetransmit(stream *Stream, window map[uint32]*windowSlot, base, ackSeq, nextSeq uint32, cc *congestionControl) {
+	for seq := base; seq < ackSeq; seq++ {
+		slot := window[seq]
+		if slot.acked {
+			continue
+		}
+		slot.laterAcks++
+		if slot.laterAcks != DupAckLimit {
+			continue
+		}
+		Logger.Printf("Packet %d passed by %d ACKs, fast retransmit", seq, DupAckLimit)
+		cc.onFastRetransmit(seq, nextSeq)
+		slot.retries++
+		slot.sentAt = time.Now()
+		slot.packet.Flags |= FlagRetransmit
+		if err := stream.Send(slot.packet); err != nil {
+			Logger.Printf("Error sending packet %d: %v", seq, err)
+		}
 	}
+}
+
+// resendNacked retransmits a packet the receiver got corrupted. Corruption
+// is not congestion, so the window is left alone; a NACK for a packet
+// resent less than an RTT ago is ignored, as the copy is still in flight.
+func resendNacked(stream *Stream, window map[uint32]*windowSlot, base, seq, nextSeq uint32, cc *congestionControl) {
+	if seq < base || seq >= nextSeq {
+		return
+	}
+	slot := window[seq]
+	if slot.acked || time.Since(slot.sentAt) < cc.srtt {
+		return
+	}
+	Logger.Printf("NACK for packet %d, retransmitting", seq)
+	slot.retries++
+	slot.sentAt = time.Now()
+	slot.packet.Flags |= FlagRetransmit
+	if err := stream.Send(slot.packet); err != nil {
+		Logger.Printf("Error sending packet %d: %v", seq, err)
+	}
+}
+
+// Download receives a file over stream into file, which the caller has
+// created and Download closes, verifies its checksum and prints a summary.
+// A file that fails verification is removed.
+func Download(file *os.File, stream *Stream, opts TransferOptions) error {
 	defer file.Close()
 
-	buffer := make([]byte, ChunkSize+4)
+	received, err := receiveData(file, stream, opts, printProgress)
+	if err == nil {
+		err = verifyChecksum(file, received)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	Logger.Printf("Download completed (%d bytes)", received.bytes)
+	fmt.Printf("\nDownload complete (%d bytes, %d recovered by FEC, %d corrupted packets dropped, %d NACKs sent)\n",
+		received.bytes, received.recovered, stream.Corrupted, received.nacks)
+	return nil
+}
+
+// DownloadBytes receives what UploadBytes sent with the same opts.
+func DownloadBytes(stream *Stream, opts TransferOptions) ([]byte, error) {
+	var buffer bytes.Buffer
+	received, err := receiveData(&buffer, stream, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(bytes.NewReader(buffer.Bytes()), received); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// receivedData is the outcome of receiveData: the counters plus what is
+// needed to verify the data.
+type receivedData struct {
+	transferStats
+	checksum string
+	hasher   hash.Hash
+}
+
+// receiveData receives a selective-repeat transfer into w. Packets inside
+// the window but ahead of the next expected one are ACKed and buffered
+// until the gap before them is filled. With opts.FECBlock set, a packet
+// lost from a block is rebuilt from the block's parity and ACKed as if it
+// had arrived.
+func receiveData(w io.Writer, stream *Stream, opts TransferOptions, progress func(current, total int64)) (receivedData, error) {
+	var result receivedData
 	expectedSeq := uint32(0)
-	var received int64
+	pending := make(map[uint32][]byte)
 
-	for {
-		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-		n, remote, err := conn.ReadFromUDP(buffer)
+	hasher, err := NewHash(HashAlgorithm)
+	if err != nil {
+		return result, err
+	}
+	result.hasher = hasher
+	eofSeq := uint32(0)
+	var checksum string
+
+	var fec *parityDecoder
+	if opts.FECBlock > 0 {
+		fec = newParityDecoder(opts.FECBlock)
+	}
+	accept := func(seq uint32, data []byte) {
+		pending[seq] = append([]byte(nil), data...)
+		Logger.Printf("Sending ACK for packet %d", seq)
+		sendAck(stream, seq)
+	}
+	rebuild := func(seq uint32, data []byte, ok bool) {
+		if !ok || seq < expectedSeq {
+			return
+		}
+		if _, have := pending[seq]; have {
+			return
+		}
+		Logger.Printf("Recovered packet %d from parity", seq)
+		accept(seq, data)
+		result.recovered++
+	}
+	// flushPending writes out the run of buffered packets starting at
+	// expectedSeq.
+	flushPending := func() error {
+		for {
+			chunk, ok := pending[expectedSeq]
+			if !ok {
+				return nil
+			}
+			if _, err := w.Write(chunk); err != nil {
+				err = fmt.Errorf("error writing packet %d: %v", expectedSeq, err)
+				sendError(stream, err)
+				return err
+			}
+			hasher.Write(chunk)
+			result.bytes += int64(len(chunk))
+			if progress != nil {
+				progress(result.bytes, 0)
+			}
+			delete(pending, expectedSeq)
+			expectedSeq++
+		}
+	}
+
+	for checksum == "" || expectedSeq < eofSeq {
+		packet, err := stream.Receive(time.Now().Add(opts.receiveTimeout()))
+		if errors.Is(err, ErrCorrupt) {
+			// The sequence number may be damaged too; a NACK for a packet
+			// the sender does not have in flight is ignored.
+			seq := packet.Seq
+			if _, ok := pending[seq]; !ok && seq >= expectedSeq && seq < expectedSeq+WindowSize {
+				Logger.Printf("Sending NACK for packet %d", seq)
+				stream.Send(Packet{Type: TypeNack, Seq: seq})
+				result.nacks++
+			}
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("read timeout: %v", err)
+			return result, fmt.Errorf("read timeout: %v", err)
 		}
 
-		if remote.String() != addr.String() {
+		switch packet.Type {
+		case TypeData, TypeEOF:
+		case TypeParity:
+			if fec != nil {
+				rebuild(fec.addParity(packet, expectedSeq))
+				if err := flushPending(); err != nil {
+					return result, err
+				}
+			}
+			continue
+		case TypeError:
+			return result, fmt.Errorf("sender aborted: %s", packet.Payload)
+		default:
 			continue
 		}
 
-		seq, data := ParsePacket(buffer[:n])
-		if seq == 0 && data == nil {
+		seq, data := packet.Seq, packet.Payload
+
+		if seq < expectedSeq {
+			Logger.Printf("Re-sending ACK for old packet %d", seq)
+			sendAck(stream, seq)
+			continue
+		}
+		if seq >= expectedSeq+WindowSize {
 			continue
 		}
 
-		Logger.Printf("Received packet %d (%d bytes)", seq, len(data))
+		if packet.Flags&FlagRetransmit != 0 {
+			Logger.Printf("Received retransmitted packet %d (%d bytes)", seq, len(data))
+		} else {
+			Logger.Printf("Received packet %d (%d bytes)", seq, len(data))
+		}
 
-		if string(data) == "EOF" {
-			ack := make([]byte, 4)
-			binary.BigEndian.PutUint32(ack, seq)
-			conn.WriteToUDP(ack, addr)
-			break
+		if packet.Type == TypeEOF {
+			eofSeq = seq
+			checksum = string(data)
+			continue
 		}
 
-		if seq == expectedSeq {
-			if _, err := file.Write(data); err != nil {
-				Logger.Printf("Error writing packet %d: %v", seq, err)
-				continue
-			}
-			received += int64(len(data))
-			printProgress(received, 0)
-			expectedSeq++
+		if _, ok := pending[seq]; ok {
+			Logger.Printf("Re-sending ACK for packet %d", seq)
+			sendAck(stream, seq)
+			continue
+		}
+		accept(seq, data)
+		if fec != nil {
+			rebuild(fec.addData(seq, data))
+		}
+		if err := flushPending(); err != nil {
+			return result, err
+		}
+	}
 
-			ack := make([]byte, 4)
-			binary.BigEndian.PutUint32(ack, seq)
-			Logger.Printf("Sending ACK for packet %d", seq)
-			conn.WriteToUDP(ack, addr)
-		} else if seq < expectedSeq {
-			ack := make([]byte, 4)
-			binary.BigEndian.PutUint32(ack, seq)
-			Logger.Printf("Re-sending ACK for old packet %d", seq)
-			conn.WriteToUDP(ack, addr)
+	// Everything before EOF is written, so its ACK tells the sender the
+	// whole transfer arrived.
+	sendAck(stream, eofSeq)
+	result.checksum = checksum
+	return result, nil
+}
+
+// Linger keeps answering a finished download's stream: a retransmission
+// arriving now means the sender missed the final ACK, which would
+// otherwise fail its upload. It returns once the stream has been quiet for
+// LingerTimeout.
+func Linger(stream *Stream) {
+	for {
+		packet, err := stream.Receive(time.Now().Add(LingerTimeout))
+		if errors.Is(err, ErrCorrupt) {
+			continue
+		}
+		if err != nil {
+			return
 		}
+		if packet.Type == TypeData || packet.Type == TypeEOF {
+			Logger.Printf("Re-sending ACK for packet %d after transfer end", packet.Seq)
+			sendAck(stream, packet.Seq)
+		}
+	}
+}
+
+// verifyChecksum compares the "algorithm:hexdigest" checksum from the EOF
+// packet with the streamed hash, re-reading the data if the sender used a
+// different algorithm.
+func verifyChecksum(data io.ReaderAt, received receivedData) error {
+	streamed, checksum := received.hasher, received.checksum
+	algorithm, expected, ok := strings.Cut(checksum, ":")
+	if !ok || expected == "" {
+		return fmt.Errorf("invalid checksum %q", checksum)
 	}
 
-	Logger.Printf("Download completed (%d bytes)", received)
-	fmt.Println("\nDownload complete")
+	actual := hex.EncodeToString(streamed.Sum(nil))
+	if algorithm != HashAlgorithm {
+		hasher, err := NewHash(algorithm)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(hasher, io.NewSectionReader(data, 0, 1<<62)); err != nil {
+			return fmt.Errorf("error hashing file: %v", err)
+		}
+		actual = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	if actual != strings.ToLower(expected) {
+		return fmt.Errorf("%s checksum mismatch", algorithm)
+	}
+	Logger.Printf("%s checksum verified", algorithm)
 	return nil
 }
 
+// NewHash returns a hasher for one of the supported checksum algorithms.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
+
+func sendAck(stream *Stream, seq uint32) {
+	stream.Send(Packet{Type: TypeAck, Seq: seq})
+}
+
+// sendError tells the peer the transfer is abandoned so it does not wait
+// for a timeout.
+func sendError(stream *Stream, err error) {
+	stream.Send(Packet{Type: TypeError, Payload: []byte(err.Error())})
+}
+
 func printProgress(current, total int64) {
 	var percent float64
 	if total > 0 {
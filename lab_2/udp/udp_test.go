@@ -0,0 +1,213 @@
+package udp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	Logger = log.New(io.Discard, "", 0)
+}
+
+// linkAction is what a test link does with a datagram.
+type linkAction int
+
+const (
+	pass linkAction = iota
+	drop
+	hold // deliver after the next datagram
+)
+
+// relay reads conn, standing in for Mux.Serve, and delivers what filter
+// lets through to m.
+func relay(conn *net.UDPConn, m *Mux, filter func(Packet) linkAction) {
+	buffer := make([]byte, MaxPacketSize)
+	var held []byte
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		datagram := append([]byte(nil), buffer[:n]...)
+		action := pass
+		if p, err := ParsePacket(datagram); err == nil && filter != nil {
+			action = filter(p)
+		}
+		switch {
+		case action == drop:
+			continue
+		case action == hold && held == nil:
+			held = datagram
+			continue
+		}
+		m.Deliver(datagram)
+		if held != nil {
+			m.Deliver(held)
+			held = nil
+		}
+	}
+}
+
+// newTestLink connects two muxes over loopback. toReceiver and toSender,
+// either of which may be nil, filter what the receiving and the sending
+// side get.
+func newTestLink(t *testing.T, toReceiver, toSender func(Packet) linkAction) (sender, receiver *Mux) {
+	t.Helper()
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	a, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	sender = NewMux(a, b.LocalAddr().(*net.UDPAddr))
+	receiver = NewMux(b, a.LocalAddr().(*net.UDPAddr))
+	go relay(a, sender, toSender)
+	go relay(b, receiver, toReceiver)
+	return sender, receiver
+}
+
+// firstCopy returns a filter that applies action to the first packet of
+// packetType, on each stream, whose sequence number match selects. Later
+// copies, such as retransmissions, pass.
+func firstCopy(packetType PacketType, action linkAction, match func(seq uint32) bool) func(Packet) linkAction {
+	type key struct{ stream, seq uint32 }
+	seen := make(map[key]bool)
+	return func(p Packet) linkAction {
+		k := key{p.TransferID, p.Seq}
+		if p.Type != packetType || !match(p.Seq) || seen[k] {
+			return pass
+		}
+		seen[k] = true
+		return action
+	}
+}
+
+// testData returns size bytes that differ from packet to packet.
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/MinChunkSize)
+	}
+	return data
+}
+
+// transfer sends data from sender to receiver on stream id, checks that
+// it arrived intact and returns what both sides counted.
+func transfer(sender, receiver *Mux, id uint32, data []byte, opts TransferOptions) (transferStats, receivedData, error) {
+	out, in := sender.Open(id, 4*WindowSize), receiver.Open(id, 4*WindowSize)
+	defer sender.Close(id)
+	defer receiver.Close(id)
+
+	var received bytes.Buffer
+	var result receivedData
+	var receiveErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, receiveErr = receiveData(&received, in, opts, nil)
+		if receiveErr == nil {
+			receiveErr = verifyChecksum(bytes.NewReader(received.Bytes()), result)
+		}
+	}()
+
+	stats, err := sendData(bytes.NewReader(data), int64(len(data)), out, opts, nil)
+	<-done
+	switch {
+	case err != nil:
+		return stats, result, fmt.Errorf("stream %d: send: %v", id, err)
+	case receiveErr != nil:
+		return stats, result, fmt.Errorf("stream %d: receive: %v", id, receiveErr)
+	case !bytes.Equal(received.Bytes(), data):
+		return stats, result, fmt.Errorf("stream %d: received %d bytes that differ from the %d sent", id, received.Len(), len(data))
+	case stats.bytes != int64(len(data)):
+		return stats, result, fmt.Errorf("stream %d: sender counted %d bytes acknowledged, want %d", id, stats.bytes, len(data))
+	}
+	return stats, result, nil
+}
+
+var testOptions = TransferOptions{ChunkSize: MinChunkSize, ReceiveTimeout: 10 * time.Second}
+
+func TestTransferReordered(t *testing.T) {
+	// Every fourth data packet arrives after the one that follows it.
+	sender, receiver := newTestLink(t, firstCopy(TypeData, hold, func(seq uint32) bool { return seq%4 == 1 }), nil)
+	stats, _, err := transfer(sender, receiver, 1, testData(40*MinChunkSize), testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.retransmitted != 0 {
+		t.Errorf("%d retransmissions for packets that were only reordered", stats.retransmitted)
+	}
+}
+
+func TestTransferRetransmitsLostPackets(t *testing.T) {
+	lostData := func(seq uint32) bool { return seq%5 == 2 }
+	lostAcks := func(seq uint32) bool { return seq%7 == 3 }
+	sender, receiver := newTestLink(t, firstCopy(TypeData, drop, lostData), firstCopy(TypeAck, drop, lostAcks))
+
+	const packets = 40
+	stats, _, err := transfer(sender, receiver, 1, testData(packets*MinChunkSize-MinChunkSize/2), testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := 0
+	for seq := uint32(0); seq < packets; seq++ {
+		if lostData(seq) {
+			lost++
+		}
+	}
+	if stats.retransmitted < lost {
+		t.Errorf("%d retransmissions for %d lost packets", stats.retransmitted, lost)
+	}
+}
+
+func TestTransfersShareOneLink(t *testing.T) {
+	// Losing the first copy of packet 2 on every stream checks that ACKs
+	// and retransmissions reach the right transfer.
+	sender, receiver := newTestLink(t, firstCopy(TypeData, drop, func(seq uint32) bool { return seq == 2 }), nil)
+	var wg sync.WaitGroup
+	for id := uint32(1); id <= 4; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := transfer(sender, receiver, id, testData(int(id)*10*MinChunkSize), testOptions); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTransferRecoversLostPacketsFromParity(t *testing.T) {
+	const block = 4
+	lostData := func(seq uint32) bool { return seq%block == 2 }
+	sender, receiver := newTestLink(t, firstCopy(TypeData, drop, lostData), nil)
+
+	opts := testOptions
+	opts.FECBlock = block
+	const packets = 10 * block
+	stats, result, err := transfer(sender, receiver, 1, testData(packets*MinChunkSize), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.recovered != packets/block {
+		t.Errorf("%d packets recovered from parity, want %d", result.recovered, packets/block)
+	}
+	if stats.parity != packets/block {
+		t.Errorf("%d parity packets sent, want %d", stats.parity, packets/block)
+	}
+}
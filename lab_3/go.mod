@@ -2,7 +2,11 @@ module lab_3
 
 go 1.24
 
-require github.com/cloudwego/netpoll v0.7.0
+require (
+	github.com/cloudwego/netpoll v0.7.0
+	golang.org/x/crypto v0.22.0
+	golang.org/x/sys v0.19.0
+)
 
 require (
 	github.com/bytedance/gopkg v0.1.1 // indirect
@@ -0,0 +1,66 @@
+package server
+
+import "golang.org/x/sys/unix"
+
+// EpollBatch is how many ready descriptors one epoll wakeup returns at most.
+const EpollBatch = 256
+
+// epollPoller is the Linux backend. The kernel keeps the interest list, so
+// a wakeup costs only as much as the descriptors that are ready, however
+// many idle connections are open. It is level-triggered: a descriptor that
+// is still readable or writable after one step of work is reported again.
+type epollPoller struct {
+	epfd   int
+	events []unix.EpollEvent
+	ready  []int
+}
+
+func newEpollPoller() (Poller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epollPoller{epfd: epfd, events: make([]unix.EpollEvent, EpollBatch)}, nil
+}
+
+func (p *epollPoller) Add(fd int, interest Interest) error {
+	event := unix.EpollEvent{Events: epollEvents(interest), Fd: int32(fd)}
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, fd, &event)
+}
+
+func (p *epollPoller) Modify(fd int, interest Interest) error {
+	event := unix.EpollEvent{Events: epollEvents(interest), Fd: int32(fd)}
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_MOD, fd, &event)
+}
+
+func (p *epollPoller) Remove(fd int) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (p *epollPoller) Wait() ([]int, error) {
+	n, err := unix.EpollWait(p.epfd, p.events, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	p.ready = p.ready[:0]
+	for i := 0; i < n; i++ {
+		p.ready = append(p.ready, int(p.events[i].Fd))
+	}
+	return p.ready, nil
+}
+
+func (p *epollPoller) Close() error {
+	return unix.Close(p.epfd)
+}
+
+func epollEvents(interest Interest) uint32 {
+	var events uint32
+	if interest&Readable != 0 {
+		events |= unix.EPOLLIN | unix.EPOLLRDHUP
+	}
+	if interest&Writable != 0 {
+		events |= unix.EPOLLOUT
+	}
+	return events
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+func newEpollPoller() (Poller, error) {
+	return nil, errors.New("epoll is only available on linux")
+}
@@ -0,0 +1,528 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"lab_3/auth"
+	"lab_3/tcp"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/cloudwego/netpoll"
+)
+
+// NetpollServer serves the same commands as Server, confined to Root in
+// the same way and with the same logins, on cloudwego/netpoll's event
+// loop. netpoll reads ready connections into their input buffers and runs
+// handleRequest for each on its goroutine pool, so unlike the hand-rolled
+// loop a transfer may simply block its own connection. With TLS set,
+// every connection starts with a TLS handshake, see serveTLS.
+type NetpollServer struct {
+	ServerAddr string
+	Root       string
+	Users      *auth.Users
+	TLS        *tls.Config
+	EventLoop  netpoll.EventLoop
+	jail       *Jail
+	clients    map[netpoll.Connection]*netpollClient
+	handlers   sync.WaitGroup
+	draining   bool
+	mu         sync.Mutex
+}
+
+// netpollClient is the per-connection state, carried in the context
+// netpoll hands to every callback of the connection. Busy is set while a
+// command, and any transfer it starts, is being handled. The unexported
+// fields are those of ClientConn.
+type netpollClient struct {
+	Fd         int
+	Addr       string
+	CurrentDir string
+	Busy       bool
+	secure     *tcp.Conn // the TLS session, once the handshake is done
+	user       *auth.User
+	home       *Jail
+	failures   int
+}
+
+type clientKey struct{}
+
+func (s *NetpollServer) RunServer() {
+	address, err := tcp.GetIP()
+	if err != nil {
+		fmt.Printf("error getting IP address: %v\n", err)
+		return
+	}
+
+	s.jail, err = NewJail(s.Root)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	s.clients = make(map[netpoll.Connection]*netpollClient)
+	if s.ServerAddr == "" {
+		s.ServerAddr = fmt.Sprintf("127.0.0.1:%d", tcp.Port)
+	}
+	listener, err := netpoll.CreateListener("tcp", s.ServerAddr)
+	if err != nil {
+		fmt.Printf("error starting server: %v\n", err)
+		return
+	}
+	defer listener.Close()
+
+	s.EventLoop, err = netpoll.NewEventLoop(s.handleRequest,
+		netpoll.WithOnConnect(s.handleConnect),
+		netpoll.WithOnDisconnect(s.handleDisconnect))
+	if err != nil {
+		fmt.Printf("error creating event loop: %v\n", err)
+		return
+	}
+
+	fmt.Printf("server started on address %s, listening on %s, serving %s (netpoll)\n", address, listener.Addr(), s.jail.Root)
+	announceUsers(s.Users)
+	announceTLS(s.TLS)
+	stopped := make(chan struct{})
+	go s.awaitShutdown(stopped)
+	if err := s.EventLoop.Serve(listener); err != nil {
+		fmt.Printf("event loop stopped: %v\n", err)
+		return
+	}
+	<-stopped
+	fmt.Println("server stopped")
+}
+
+// awaitShutdown waits for SIGINT or SIGTERM, dismisses idle clients and
+// has netpoll stop accepting and wait for the busy ones. Those still busy
+// after DrainTimeout, or on a second signal, are cut off; a partially
+// uploaded file is removed.
+func (s *NetpollServer) awaitShutdown(stopped chan<- struct{}) {
+	defer close(stopped)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	sig := <-signals
+	fmt.Printf("received %v, shutting down\n", sig)
+	if busy := s.drain(); busy > 0 {
+		fmt.Printf("waiting up to %s for %d busy clients\n", DrainTimeout, busy)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DrainTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Printf("received %v again\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := s.EventLoop.Shutdown(ctx); err != nil {
+		s.cutOff()
+	}
+	s.handlers.Wait()
+}
+
+// drain marks the server as shutting down and dismisses the idle clients.
+// It returns how many are busy; they are dismissed as they finish.
+func (s *NetpollServer) drain() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	busy := 0
+	for conn, client := range s.clients {
+		if client.Busy {
+			busy++
+			continue
+		}
+		s.dismiss(conn)
+	}
+	return busy
+}
+
+func (s *NetpollServer) cutOff() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, client := range s.clients {
+		fmt.Printf("cutting off %s (fd: %d)\n", client.Addr, client.Fd)
+		delete(s.clients, conn)
+		_ = conn.Close()
+	}
+}
+
+// dismiss tells a client the server is going away and disconnects it. A
+// client still in its TLS handshake cannot be told. The caller holds s.mu.
+func (s *NetpollServer) dismiss(conn netpoll.Connection) {
+	client := s.clients[conn]
+	delete(s.clients, conn)
+	if s.TLS == nil || client.secure != nil {
+		_ = conn.SetWriteTimeout(NoticeTimeout)
+		_ = client.reply(conn, tcp.ShutdownNotice)
+	}
+	_ = conn.Close()
+}
+
+func (s *NetpollServer) handleConnect(ctx context.Context, conn netpoll.Connection) context.Context {
+	client := &netpollClient{
+		Addr:       conn.RemoteAddr().String(),
+		CurrentDir: "/",
+		home:       s.jail,
+	}
+	if fdConn, ok := conn.(netpoll.Conn); ok {
+		client.Fd = fdConn.Fd()
+		if err := netpoll.SetKeepAlive(client.Fd, int(tcp.KeepaliveIdle.Seconds())); err != nil {
+			fmt.Printf("error setting keepalive: %v\n", err)
+		}
+	}
+
+	fmt.Printf("new connection from %s (fd: %d)\n", client.Addr, client.Fd)
+	s.mu.Lock()
+	s.clients[conn] = client
+	if s.draining {
+		s.dismiss(conn)
+	}
+	s.mu.Unlock()
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func (s *NetpollServer) handleDisconnect(ctx context.Context, conn netpoll.Connection) {
+	client := ctx.Value(clientKey{}).(*netpollClient)
+	s.mu.Lock()
+	delete(s.clients, conn)
+	s.mu.Unlock()
+	fmt.Printf("connection closed (fd: %d, addr: %s)\n", client.Fd, client.Addr)
+}
+
+// handleRequest runs one command. netpoll calls it again for as long as
+// input is buffered, so pipelined commands are each handled in turn.
+// During a shutdown the client is dismissed once the command is done.
+func (s *NetpollServer) handleRequest(ctx context.Context, conn netpoll.Connection) error {
+	client := ctx.Value(clientKey{}).(*netpollClient)
+	if s.TLS != nil {
+		return s.serveTLS(client, conn)
+	}
+	if !s.begin(client, conn) {
+		return nil
+	}
+	err := s.serveRequest(client, conn)
+	s.end(client, conn)
+	return err
+}
+
+// begin marks the client busy with a command, unless it has been
+// dismissed or the server is shutting down.
+func (s *NetpollServer) begin(client *netpollClient, conn netpoll.Connection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[conn] != client || s.draining {
+		return false
+	}
+	client.Busy = true
+	s.handlers.Add(1)
+	return true
+}
+
+// end marks the client's command done, and during a shutdown dismisses it.
+func (s *NetpollServer) end(client *netpollClient, conn netpoll.Connection) {
+	s.mu.Lock()
+	client.Busy = false
+	if s.draining && s.clients[conn] == client {
+		s.dismiss(conn)
+	}
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+func (s *NetpollServer) serveRequest(client *netpollClient, conn netpoll.Connection) error {
+	reader := conn.Reader()
+
+	line, err := reader.Until('\n')
+	if err != nil {
+		fmt.Printf("client %s (fd: %d) disconnected: %v\n", client.Addr, client.Fd, err)
+		return conn.Close()
+	}
+	command := strings.TrimSpace(string(line))
+	_ = reader.Release()
+	return s.runCommand(client, conn, command)
+}
+
+// serveTLS runs the handshake and then the client's commands until it
+// disconnects. TLS reads whole records off the connection, so decrypted
+// commands may be waiting that netpoll's input buffer no longer shows.
+// Rather than return after each command and wait to be called back, the
+// handler therefore keeps the connection, blocking on it between commands
+// as the goroutine-per-client servers do.
+func (s *NetpollServer) serveTLS(client *netpollClient, conn netpoll.Connection) error {
+	tlsConn, err := tcp.ServerHandshake(conn, s.TLS)
+	if err != nil {
+		fmt.Printf("connection from %s refused: %v\n", client.Addr, err)
+		return conn.Close()
+	}
+	secure := tcp.NewConn(tlsConn)
+	s.mu.Lock()
+	client.secure = secure
+	s.mu.Unlock()
+	fmt.Printf("[%s] TLS established%s\n", client.Addr, peer(secure))
+
+	for conn.IsActive() {
+		command, err := tcp.ReadData(secure)
+		if err != nil {
+			fmt.Printf("client %s (fd: %d) disconnected: %v\n", client.Addr, client.Fd, err)
+			return conn.Close()
+		}
+		if !s.begin(client, conn) {
+			return nil
+		}
+		err = s.runCommand(client, conn, command)
+		s.end(client, conn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCommand runs one command line and answers it.
+func (s *NetpollServer) runCommand(client *netpollClient, conn netpoll.Connection, command string) error {
+	if command == "" {
+		return nil
+	}
+	fmt.Printf("[%s] command: %s\n", client.Addr, redact(command))
+	parts := strings.Fields(command)
+
+	response := s.ParseCommand(client, conn, parts)
+	if response == "" {
+		return nil
+	}
+	if err := client.reply(conn, response); err != nil {
+		fmt.Printf("error sending response to %s: %v\n", client.Addr, err)
+		return conn.Close()
+	}
+	if response == "goodbye!" || response == LoginLimitNotice {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (s *NetpollServer) ParseCommand(client *netpollClient, conn netpoll.Connection, parts []string) string {
+	cmd := strings.ToLower(parts[0])
+	args := parts[1:]
+
+	if denied := authorize(s.Users, client.user, cmd); denied != "" {
+		if cmd == "upload" {
+			// The file follows the command and still has to be read.
+			return receiveFile(client, conn, errors.New(strings.TrimPrefix(denied, "error: ")), args...)
+		}
+		return denied
+	}
+
+	response := ""
+	switch cmd {
+	case "login":
+		response = s.handleLogin(client, args...)
+	case "echo":
+		response = handleEcho(args...)
+	case "time":
+		response = handleTime()
+	case "quit", "exit", "close":
+		response = "goodbye!"
+	case "ls":
+		response = handleLs(client.home, client.CurrentDir)
+	case "cd":
+		response = handleCd(client.home, &client.CurrentDir, args...)
+	case "pwd":
+		response = handlePwd(client.CurrentDir)
+	case "mkdir":
+		response = handleMkdir(client.home, client.CurrentDir, args...)
+	case "rm":
+		response = handleRm(client.home, client.CurrentDir, args...)
+	case "rmdir":
+		response = handleRmdir(client.home, client.CurrentDir, args...)
+	case "mv", "rename":
+		response = handleMv(client.home, client.CurrentDir, args...)
+	case "cp":
+		response = handleCp(client.home, client.CurrentDir, args...)
+	case "stat":
+		response = handleStat(client.home, client.CurrentDir, args...)
+	case "download":
+		sendFile(client, conn, args...)
+	case "upload":
+		response = receiveFile(client, conn, nil, args...)
+	default:
+		response = "error: unknown command"
+	}
+	return response
+}
+
+// handleLogin logs the client in and moves it to its home directory.
+func (s *NetpollServer) handleLogin(client *netpollClient, args ...string) string {
+	if s.Users == nil {
+		return "error: this server does not require a login"
+	}
+	user, home, err := login(s.Users, s.jail, args)
+	if err != nil {
+		client.failures++
+		fmt.Printf("[%s] login failed: %v\n", client.Addr, err)
+		if client.failures >= MaxLoginAttempts {
+			return LoginLimitNotice
+		}
+		return fmt.Sprintf("error: %v", err)
+	}
+	client.user, client.home, client.CurrentDir, client.failures = user, home, "/", 0
+	fmt.Printf("[%s] logged in as %s (%s)\n", client.Addr, user.Name, user.Role)
+	return fmt.Sprintf("logged in as %s (%s)", user.Name, user.Role)
+}
+
+func writeResponse(writer netpoll.Writer, response string) error {
+	if _, err := writer.WriteString(response + "\n"); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// reply writes a response line, through TLS if the client uses it.
+func (client *netpollClient) reply(conn netpoll.Connection, response string) error {
+	if client.secure != nil {
+		return tcp.SendData(client.secure, response)
+	}
+	return writeResponse(conn.Writer(), response)
+}
+
+// sendFile sends the requested file, through TLS if the client uses it.
+func sendFile(client *netpollClient, conn netpoll.Connection, args ...string) {
+	dir, args, err := client.home.fileArgs(client.CurrentDir, args)
+	var sender *tcp.FileSender
+	if err != nil {
+		sender = tcp.RefuseFile(err)
+	} else {
+		sender, err = tcp.NewFileSender(dir, args...)
+	}
+	defer func() {
+		_ = sender.Close()
+	}()
+	if err == nil {
+		fmt.Printf("[%s] sending %s (%d bytes)\n", client.Addr, sender.Name, sender.Size)
+	}
+
+	if client.secure != nil {
+		err = writeFile(client.secure, sender)
+	} else {
+		err = pushFile(conn.Writer(), sender)
+	}
+	if err != nil {
+		fmt.Printf("[%s] download failed: %v\n", client.Addr, err)
+		return
+	}
+
+	if err := sender.Err(); err != nil {
+		fmt.Printf("[%s] download failed: %v\n", client.Addr, err)
+		return
+	}
+	fmt.Printf("[%s] sent %s (%d bytes)\n", client.Addr, sender.Name, sender.Sent)
+}
+
+// pushFile writes the file transfer through the connection's output
+// buffer; each Flush returns once netpoll has handed the chunk to the
+// socket, so the sender can reuse its buffer.
+func pushFile(writer netpoll.Writer, sender *tcp.FileSender) error {
+	for !sender.Done() {
+		pending := sender.Pending()
+		buffer, err := writer.Malloc(len(pending))
+		if err != nil {
+			return err
+		}
+		sender.Advance(copy(buffer, pending))
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile writes the file transfer through a TLS connection.
+func writeFile(conn *tcp.Conn, sender *tcp.FileSender) error {
+	for !sender.Done() {
+		n, err := conn.Write(sender.Pending())
+		sender.Advance(n)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.Flush()
+}
+
+// receiveFile receives an uploaded file, through TLS if the client uses
+// it. With refusal set, the file is read and dropped, and the client told
+// why.
+func receiveFile(client *netpollClient, conn netpoll.Connection, refusal error, args ...string) string {
+	dir, args, err := client.home.fileArgs(client.CurrentDir, args)
+	receiver := tcp.NewFileReceiver(dir, args...)
+	if refusal != nil {
+		err = refusal
+	}
+	if err != nil {
+		receiver.Refuse(err)
+	}
+
+	if client.secure != nil {
+		err = readFile(client.secure, receiver)
+	} else {
+		err = pullFile(conn.Reader(), receiver)
+	}
+	if err != nil {
+		fmt.Printf("[%s] upload failed: %v\n", client.Addr, err)
+		return client.home.Hide(fmt.Sprintf("error: upload failed: %v", err))
+	}
+
+	fmt.Printf("[%s] received %s (%d bytes)\n", client.Addr, receiver.Path, receiver.Received)
+	return "upload complete"
+}
+
+// pullFile feeds the connection's input buffer to the receiver without
+// copying, taking only the transfer's bytes so a command sent right after
+// it stays buffered.
+func pullFile(reader netpoll.Reader, receiver *tcp.FileReceiver) error {
+	want := 1
+	for !receiver.Done() {
+		data, err := reader.Peek(max(want, reader.Len()))
+		if err != nil {
+			receiver.Abort()
+			return err
+		}
+
+		n, err := receiver.Feed(data)
+		_ = reader.Skip(n)
+		_ = reader.Release()
+		if err != nil {
+			return err
+		}
+
+		// Nothing usable yet: wait for more than is buffered.
+		want = 1
+		if n == 0 {
+			want = len(data) + 1
+		}
+	}
+	return nil
+}
+
+// readFile feeds what a TLS connection decrypts to the receiver. A command
+// sent right after the file stays in the connection's reader.
+func readFile(conn *tcp.Conn, receiver *tcp.FileReceiver) error {
+	for {
+		err := receiver.Drain(conn.Reader)
+		if err != nil || receiver.Done() {
+			receiver.Abort()
+			return err
+		}
+		if err := tcp.ReadMore(conn.Reader); err != nil {
+			receiver.Abort()
+			return err
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
+// Interest is what a descriptor is waited on for.
+type Interest int
+
+const (
+	Readable Interest = 1 << iota
+	Writable
+)
+
+// Poller waits for readiness on a set of descriptors. Hang-ups and errors
+// are always reported, whatever the interest, so the caller finds out on
+// its next read or write.
+type Poller interface {
+	Add(fd int, interest Interest) error
+	Modify(fd int, interest Interest) error
+	Remove(fd int) error
+	// Wait blocks until at least one descriptor is ready and returns the
+	// ready ones.
+	Wait() ([]int, error)
+	Close() error
+}
+
+// NewPoller returns the poller of the named backend, "poll" or "epoll".
+func NewPoller(backend string) (Poller, error) {
+	switch backend {
+	case "", "poll":
+		return newPollPoller(), nil
+	case "epoll":
+		return newEpollPoller()
+	default:
+		return nil, fmt.Errorf("unknown poller backend %q", backend)
+	}
+}
+
+// pollPoller is the portable backend on poll(2). It keeps the descriptors
+// in the slice poll takes, and where each one is in it so removal does not
+// search; every wakeup still scans them all.
+type pollPoller struct {
+	fds   []unix.PollFd
+	index map[int]int
+	ready []int
+}
+
+func newPollPoller() *pollPoller {
+	return &pollPoller{index: make(map[int]int)}
+}
+
+func (p *pollPoller) Add(fd int, interest Interest) error {
+	if _, ok := p.index[fd]; ok {
+		return fmt.Errorf("fd %d already added", fd)
+	}
+	p.index[fd] = len(p.fds)
+	p.fds = append(p.fds, unix.PollFd{Fd: int32(fd), Events: pollEvents(interest)})
+	return nil
+}
+
+func (p *pollPoller) Modify(fd int, interest Interest) error {
+	i, ok := p.index[fd]
+	if !ok {
+		return fmt.Errorf("fd %d not added", fd)
+	}
+	p.fds[i].Events = pollEvents(interest)
+	return nil
+}
+
+// Remove moves the last descriptor into the removed one's place.
+func (p *pollPoller) Remove(fd int) error {
+	i, ok := p.index[fd]
+	if !ok {
+		return fmt.Errorf("fd %d not added", fd)
+	}
+	last := len(p.fds) - 1
+	p.fds[i] = p.fds[last]
+	p.index[int(p.fds[i].Fd)] = i
+	p.fds = p.fds[:last]
+	delete(p.index, fd)
+	return nil
+}
+
+func (p *pollPoller) Wait() ([]int, error) {
+	n, err := unix.Poll(p.fds, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	p.ready = p.ready[:0]
+	for i := 0; i < len(p.fds) && len(p.ready) < n; i++ {
+		if p.fds[i].Revents != 0 {
+			p.ready = append(p.ready, int(p.fds[i].Fd))
+		}
+	}
+	return p.ready, nil
+}
+
+func (p *pollPoller) Close() error {
+	return nil
+}
+
+func pollEvents(interest Interest) int16 {
+	var events int16
+	if interest&Readable != 0 {
+		events |= unix.POLLIN
+	}
+	if interest&Writable != 0 {
+		events |= unix.POLLOUT
+	}
+	return events
+}
@@ -1,30 +1,54 @@
 package server
 
 import (
+	"errors"
 	"fmt"
-	"lab_4/tcp"
+	"golang.org/x/sys/unix"
+	"lab_3/auth"
+	"lab_3/tcp"
 	"net"
 	"os"
-	"path/filepath"
 	"strings"
-	"syscall"
 	"time"
 )
 
+// Server runs every client on one goroutine, waiting for readiness on
+// their sockets with the Backend poller, "poll" (the default) or "epoll".
+// It listens on ServerAddr, 127.0.0.1 and tcp.Port if empty, and serves
+// Root, the working directory if empty; clients see Root as "/" and cannot
+// leave it. With Users set, clients must log in, and then see only their
+// home directory. Draining is set once a shutdown has begun; the loop ends
+// when the last client is gone.
 type Server struct {
 	Listener    net.Listener
 	ServerAddr  string
-	CurrentDir  string
+	Root        string
+	Users       *auth.Users
+	Backend     string
+	jail        *Jail
+	Poller      Poller
 	Clients     map[int]*ClientConn
-	PollFds     []syscall.PollFd
 	ClientCount int
+	Draining    bool
 }
 
+// ClientConn is one connected client, with CurrentDir its directory under
+// the virtual root, which is its home once it has logged in. While a
+// download or upload runs, Sender or Receiver holds its progress and the
+// poll loop drives it instead of reading commands.
 type ClientConn struct {
 	Fd         int
-	Conn       net.Conn
+	Conn       *tcp.Conn
 	Addr       string
 	CurrentDir string
+	Sender     *tcp.FileSender
+	Receiver   *tcp.FileReceiver
+
+	// The logged-in user, the jail of its home and how many logins the
+	// client has failed.
+	user     *auth.User
+	home     *Jail
+	failures int
 }
 
 func (s *Server) RunServer() {
@@ -34,8 +58,14 @@ func (s *Server) RunServer() {
 		return
 	}
 
-	s.CurrentDir, _ = os.Getwd()
-	s.ServerAddr = fmt.Sprintf("127.0.0.1:%d", tcp.Port)
+	s.jail, err = NewJail(s.Root)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	if s.ServerAddr == "" {
+		s.ServerAddr = fmt.Sprintf("127.0.0.1:%d", tcp.Port)
+	}
 	s.Listener, err = net.Listen("tcp", s.ServerAddr)
 	if err != nil {
 		fmt.Printf("error starting server: %v\n", err)
@@ -43,7 +73,8 @@ func (s *Server) RunServer() {
 	}
 
 	defer s.Listener.Close()
-	fmt.Printf("server started on address %s and port %d\n", address, tcp.Port)
+	fmt.Printf("server started on address %s, listening on %s, serving %s\n", address, s.Listener.Addr(), s.jail.Root)
+	announceUsers(s.Users)
 
 	listenerFd, err := tcp.GetFd(s.Listener)
 	if err != nil {
@@ -51,34 +82,53 @@ func (s *Server) RunServer() {
 		return
 	}
 
+	s.Poller, err = NewPoller(s.Backend)
+	if err != nil {
+		fmt.Printf("error creating poller: %v\n", err)
+		return
+	}
+	defer s.Poller.Close()
+
 	s.Clients = make(map[int]*ClientConn)
-	s.PollFds = []syscall.PollFd{
-		{Fd: int32(listenerFd), Events: syscall.POLLIN},
+	if err := s.Poller.Add(listenerFd, Readable); err != nil {
+		fmt.Printf("error polling listener: %v\n", err)
+		return
 	}
 
-	for {
-		n, err := syscall.Poll(s.PollFds, -1)
-		if err != nil {
-			fmt.Printf("poll error: %v\n", err)
-			continue
-		}
+	wakeFd, stopWatching, err := watchSignals()
+	if err != nil {
+		fmt.Printf("error watching signals: %v\n", err)
+		return
+	}
+	defer stopWatching()
+	if err := s.Poller.Add(wakeFd, Readable); err != nil {
+		fmt.Printf("error polling signal pipe: %v\n", err)
+		return
+	}
 
-		if n == 0 {
+	for !s.Draining || len(s.Clients) > 0 {
+		ready, err := s.Poller.Wait()
+		if err != nil {
+			if err != unix.EINTR {
+				fmt.Printf("poll error: %v\n", err)
+			}
 			continue
 		}
 
-		for i := 0; i < len(s.PollFds); i++ {
-			if s.PollFds[i].Revents == 0 {
-				continue
-			}
-
-			if s.PollFds[i].Fd == int32(listenerFd) {
-				s.handleNewConnection()
-			} else {
-				s.handleClientRequest(int(s.PollFds[i].Fd))
+		for _, fd := range ready {
+			switch {
+			case fd == wakeFd:
+				s.handleWakeup(wakeFd, listenerFd)
+			case fd == listenerFd:
+				if !s.Draining {
+					s.handleNewConnection()
+				}
+			default:
+				s.handleClientEvent(fd)
 			}
 		}
 	}
+	fmt.Println("server stopped")
 }
 
 func (s *Server) handleNewConnection() {
@@ -105,52 +155,97 @@ func (s *Server) handleNewConnection() {
 	s.ClientCount++
 	client := &ClientConn{
 		Fd:         fd,
-		Conn:       conn,
+		Conn:       tcp.NewConn(conn),
 		Addr:       clientAddr,
-		CurrentDir: s.CurrentDir,
+		CurrentDir: "/",
+		home:       s.jail,
 	}
 
+	if err := s.Poller.Add(fd, Readable); err != nil {
+		fmt.Printf("error polling connection: %v\n", err)
+		conn.Close()
+		return
+	}
 	s.Clients[fd] = client
-	s.PollFds = append(s.PollFds, syscall.PollFd{
-		Fd:     int32(fd),
-		Events: syscall.POLLIN,
-	})
 
 	fmt.Printf("new connection from %s (fd: %d)\n", clientAddr, fd)
 }
 
+// handleClientEvent advances the client's transfer if one is running, and
+// otherwise reads its next command.
+func (s *Server) handleClientEvent(fd int) {
+	client, ok := s.Clients[fd]
+	if !ok {
+		return
+	}
+
+	switch {
+	case client.Sender != nil:
+		s.continueDownload(client)
+	case client.Receiver != nil:
+		s.continueUpload(client)
+	default:
+		s.handleClientRequest(fd)
+	}
+}
+
+// handleClientRequest makes one read from the readable socket and runs
+// every complete command it holds. A partial line waits in the client's
+// reader for the rest, so a slow client never blocks the loop.
 func (s *Server) handleClientRequest(fd int) {
 	client, ok := s.Clients[fd]
 	if !ok {
 		return
 	}
 
-	command, err := tcp.ReadData(client.Conn)
-	if err != nil {
+	err := tcp.ReadMore(client.Conn.Reader)
+	s.runBufferedCommands(client)
+	if err != nil && s.Clients[fd] == client {
 		fmt.Printf("client %s (fd: %d) disconnected: %v\n", client.Addr, fd, err)
 		s.removeClient(fd)
-		return
 	}
+}
 
-	if command == "" {
-		return
+// runBufferedCommands runs the commands already in the client's reader.
+// Poll only reports new data on the socket, so pipelined commands that
+// arrived together have to be drained here. It stops at a transfer, which
+// consumes the data behind its command itself, and is called again once
+// the transfer is over, or, during a shutdown, dismisses the client.
+func (s *Server) runBufferedCommands(client *ClientConn) {
+	for s.Clients[client.Fd] == client && client.Sender == nil && client.Receiver == nil {
+		if s.Draining {
+			s.dismiss(client)
+			return
+		}
+		command, ok := tcp.BufferedLine(client.Conn.Reader)
+		if !ok {
+			if client.Conn.Reader.Buffered() == client.Conn.Reader.Size() {
+				fmt.Printf("client %s (fd: %d) sent a command longer than %d bytes\n",
+					client.Addr, client.Fd, client.Conn.Reader.Size())
+				s.removeClient(client.Fd)
+			}
+			return
+		}
+		s.runCommand(client, command)
 	}
+}
 
-	fmt.Printf("[%s] command: %s\n", client.Addr, command)
+func (s *Server) runCommand(client *ClientConn, command string) {
 	parts := strings.Fields(command)
 	if len(parts) == 0 {
 		return
 	}
+	fmt.Printf("[%s] command: %s\n", client.Addr, redact(command))
 
 	response := s.ParseCommand(client, parts)
 	if response != "" {
 		if err := tcp.SendData(client.Conn, response); err != nil {
 			fmt.Printf("error sending response to %s: %v\n", client.Addr, err)
-			s.removeClient(fd)
+			s.removeClient(client.Fd)
 			return
 		}
-		if response == "goodbye!" {
-			s.removeClient(fd)
+		if response == "goodbye!" || response == LoginLimitNotice {
+			s.removeClient(client.Fd)
 		}
 	}
 }
@@ -161,16 +256,16 @@ func (s *Server) removeClient(fd int) {
 		return
 	}
 
+	if client.Sender != nil {
+		_ = client.Sender.Close()
+	}
+	if client.Receiver != nil {
+		client.Receiver.Abort()
+	}
+	_ = s.Poller.Remove(fd)
 	client.Conn.Close()
 	delete(s.Clients, fd)
 
-	for i := 0; i < len(s.PollFds); i++ {
-		if s.PollFds[i].Fd == int32(fd) {
-			s.PollFds = append(s.PollFds[:i], s.PollFds[i+1:]...)
-			break
-		}
-	}
-
 	fmt.Printf("connection closed (fd: %d, addr: %s)\n", fd, client.Addr)
 }
 
@@ -178,8 +273,19 @@ func (s *Server) ParseCommand(client *ClientConn, parts []string) string {
 	cmd := strings.ToLower(parts[0])
 	args := parts[1:]
 
+	if denied := authorize(s.Users, client.user, cmd); denied != "" {
+		if cmd == "upload" {
+			// The file follows the command and still has to be read.
+			s.startUpload(client, errors.New(strings.TrimPrefix(denied, "error: ")), args...)
+			return ""
+		}
+		return denied
+	}
+
 	response := ""
 	switch cmd {
+	case "login":
+		response = s.handleLogin(client, args...)
 	case "echo":
 		response = handleEcho(args...)
 	case "time":
@@ -187,19 +293,53 @@ func (s *Server) ParseCommand(client *ClientConn, parts []string) string {
 	case "quit", "exit", "close":
 		response = "goodbye!"
 	case "ls":
-		response = handleLs(client.CurrentDir)
+		response = handleLs(client.home, client.CurrentDir)
 	case "cd":
-		response = handleCd(&client.CurrentDir, args...)
+		response = handleCd(client.home, &client.CurrentDir, args...)
+	case "pwd":
+		response = handlePwd(client.CurrentDir)
+	case "mkdir":
+		response = handleMkdir(client.home, client.CurrentDir, args...)
+	case "rm":
+		response = handleRm(client.home, client.CurrentDir, args...)
+	case "rmdir":
+		response = handleRmdir(client.home, client.CurrentDir, args...)
+	case "mv", "rename":
+		response = handleMv(client.home, client.CurrentDir, args...)
+	case "cp":
+		response = handleCp(client.home, client.CurrentDir, args...)
+	case "stat":
+		response = handleStat(client.home, client.CurrentDir, args...)
 	case "download":
-		tcp.Upload(client.CurrentDir, client.Conn, args...)
+		s.startDownload(client, args...)
 	case "upload":
-		tcp.Download(client.CurrentDir, client.Conn, args...)
+		// Answered by the transfer once the file is in.
+		s.startUpload(client, nil, args...)
 	default:
 		response = "error: unknown command"
 	}
 	return response
 }
 
+// handleLogin logs the client in and moves it to its home directory.
+func (s *Server) handleLogin(client *ClientConn, args ...string) string {
+	if s.Users == nil {
+		return "error: this server does not require a login"
+	}
+	user, home, err := login(s.Users, s.jail, args)
+	if err != nil {
+		client.failures++
+		fmt.Printf("[%s] login failed: %v\n", client.Addr, err)
+		if client.failures >= MaxLoginAttempts {
+			return LoginLimitNotice
+		}
+		return fmt.Sprintf("error: %v", err)
+	}
+	client.user, client.home, client.CurrentDir, client.failures = user, home, "/", 0
+	fmt.Printf("[%s] logged in as %s (%s)\n", client.Addr, user.Name, user.Role)
+	return fmt.Sprintf("logged in as %s (%s)", user.Name, user.Role)
+}
+
 func handleEcho(args ...string) string {
 	return strings.Join(args, " ")
 }
@@ -208,10 +348,14 @@ func handleTime() string {
 	return time.Now().Format("15:04:05.000")
 }
 
-func handleLs(dir string) string {
+func handleLs(jail *Jail, currentDir string) string {
+	dir, _, err := jail.Resolve(currentDir, ".")
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
 	files, err := os.ReadDir(dir)
 	if err != nil {
-		return fmt.Sprintf("error reading directory '%s': %v", dir, err)
+		return fmt.Sprintf("error reading directory '%s'", currentDir)
 	}
 
 	var result []string
@@ -229,22 +373,21 @@ func handleLs(dir string) string {
 	return strings.Join(result, "   ")
 }
 
-func handleCd(currentDir *string, args ...string) string {
+func handleCd(jail *Jail, currentDir *string, args ...string) string {
 	if len(args) == 0 {
 		return "error: path required"
 	}
 
-	newPath := filepath.Join(*currentDir, args[0])
-	absPath, err := filepath.Abs(newPath)
+	realPath, newDir, err := jail.Resolve(*currentDir, args[0])
 	if err != nil {
-		return fmt.Sprintf("error getting absolute path: %v", err)
+		return fmt.Sprintf("error: %v", err)
 	}
 
-	info, err := os.Stat(absPath)
+	info, err := os.Stat(realPath)
 	if err != nil || !info.IsDir() {
-		return fmt.Sprintf("error: path does not exist or is not a directory: %s", absPath)
+		return fmt.Sprintf("error: path does not exist or is not a directory: %s", newDir)
 	}
 
-	*currentDir = absPath
-	return fmt.Sprintf("changed directory to %s", absPath)
+	*currentDir = newDir
+	return fmt.Sprintf("changed directory to %s", newDir)
 }
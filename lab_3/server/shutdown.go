@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"lab_3/tcp"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DrainTimeout is how long a shutdown lets running transfers finish before
+// their clients are cut off.
+var DrainTimeout = 30 * time.Second
+
+// NoticeTimeout bounds writes of shutdown notices.
+const NoticeTimeout = 100 * time.Millisecond
+
+// watchSignals wakes the event loop for a shutdown. SIGINT or SIGTERM
+// writes a byte to a pipe the loop polls, and DrainTimeout later, or on a
+// second signal, another one. It returns the read end of the pipe and a
+// function that stops watching and closes it.
+func watchSignals() (int, func(), error) {
+	var pipe [2]int
+	if err := unix.Pipe(pipe[:]); err != nil {
+		return -1, nil, fmt.Errorf("error creating pipe: %v", err)
+	}
+	for _, fd := range pipe {
+		unix.CloseOnExec(fd)
+		_ = unix.SetNonblock(fd, true)
+	}
+	wake := func() {
+		_, _ = unix.Write(pipe[1], []byte{0})
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("received %v, shutting down\n", sig)
+		wake()
+		select {
+		case <-time.After(DrainTimeout):
+		case sig = <-signals:
+			fmt.Printf("received %v again\n", sig)
+		}
+		wake()
+	}()
+
+	stop := func() {
+		signal.Stop(signals)
+		_ = unix.Close(pipe[0])
+		_ = unix.Close(pipe[1])
+	}
+	return pipe[0], stop, nil
+}
+
+// handleWakeup empties the pipe and moves the shutdown on: the first
+// wakeup drains the server, the second cuts off what is still running.
+func (s *Server) handleWakeup(wakeFd, listenerFd int) {
+	buffer := make([]byte, 16)
+	for {
+		if n, _ := unix.Read(wakeFd, buffer); n <= 0 {
+			break
+		}
+	}
+
+	if s.Draining {
+		s.cutOff()
+	} else {
+		s.drain(listenerFd)
+	}
+}
+
+// drain stops accepting and disconnects idle clients with a notice. Those
+// in the middle of a transfer get theirs when it is over.
+func (s *Server) drain(listenerFd int) {
+	s.Draining = true
+	_ = s.Poller.Remove(listenerFd)
+	_ = s.Listener.Close()
+
+	busy := 0
+	for _, client := range s.Clients {
+		if client.Sender != nil || client.Receiver != nil {
+			busy++
+			continue
+		}
+		s.dismiss(client)
+	}
+	if busy > 0 {
+		fmt.Printf("waiting up to %s for %d transfers\n", DrainTimeout, busy)
+	}
+}
+
+// cutOff disconnects the clients whose transfers are still running. A
+// partially uploaded file is removed.
+func (s *Server) cutOff() {
+	for fd, client := range s.Clients {
+		fmt.Printf("cutting off %s (fd: %d)\n", client.Addr, fd)
+		s.removeClient(fd)
+	}
+}
+
+// dismiss tells an idle client the server is going away and disconnects it.
+func (s *Server) dismiss(client *ClientConn) {
+	_ = client.Conn.SetWriteDeadline(time.Now().Add(NoticeTimeout))
+	_ = tcp.SendData(client.Conn, tcp.ShutdownNotice)
+	s.removeClient(client.Fd)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"lab_3/tcp"
+)
+
+// startDownload queues the requested file for sending. The poll loop then
+// writes it out as the socket becomes writable, one chunk per wakeup, so
+// the other clients are served in between. Only hashing the file for its
+// metadata is done up front, at disk speed.
+func (s *Server) startDownload(client *ClientConn, args ...string) {
+	dir, args, err := client.home.fileArgs(client.CurrentDir, args)
+	var sender *tcp.FileSender
+	if err != nil {
+		sender = tcp.RefuseFile(err)
+	} else {
+		sender, err = tcp.NewFileSender(dir, args...)
+	}
+	if err == nil {
+		fmt.Printf("[%s] sending %s (%d bytes)\n", client.Addr, sender.Name, sender.Size)
+	}
+	client.Sender = sender
+	s.setInterest(client, Writable)
+}
+
+// continueDownload makes one non-blocking write of the pending transfer.
+func (s *Server) continueDownload(client *ClientConn) {
+	sender := client.Sender
+	if pending := sender.Pending(); len(pending) > 0 {
+		n, err := unix.Write(client.Fd, pending)
+		if n > 0 {
+			sender.Advance(n)
+		}
+		if err != nil && err != unix.EAGAIN {
+			fmt.Printf("[%s] download of %s failed: %v\n", client.Addr, sender.Name, err)
+			s.removeClient(client.Fd)
+			return
+		}
+	}
+	if !sender.Done() {
+		return
+	}
+
+	if err := sender.Err(); err != nil {
+		fmt.Printf("[%s] download failed: %v\n", client.Addr, err)
+	} else {
+		fmt.Printf("[%s] sent %s (%d bytes)\n", client.Addr, sender.Name, sender.Sent)
+	}
+	_ = sender.Close()
+	client.Sender = nil
+	s.setInterest(client, Readable)
+	s.runBufferedCommands(client)
+}
+
+// startUpload prepares to receive a file. The client sends it right behind
+// the command, so part of it may already be buffered. With refusal set,
+// the file is read and dropped, and the client told why.
+func (s *Server) startUpload(client *ClientConn, refusal error, args ...string) {
+	dir, args, err := client.home.fileArgs(client.CurrentDir, args)
+	client.Receiver = tcp.NewFileReceiver(dir, args...)
+	if refusal != nil {
+		err = refusal
+	}
+	if err != nil {
+		client.Receiver.Refuse(err)
+	}
+	s.receive(client, client.Receiver.Drain(client.Conn.Reader))
+}
+
+// continueUpload makes one read from the readable socket and consumes it.
+func (s *Server) continueUpload(client *ClientConn) {
+	receiver := client.Receiver
+	if err := tcp.ReadMore(client.Conn.Reader); err != nil {
+		// Whatever arrived before the connection closed is still used, but
+		// the upload cannot complete without the rest.
+		_ = receiver.Drain(client.Conn.Reader)
+		receiver.Abort()
+		fmt.Printf("client %s (fd: %d) disconnected during upload: %v\n", client.Addr, client.Fd, err)
+		s.removeClient(client.Fd)
+		return
+	}
+	s.receive(client, receiver.Drain(client.Conn.Reader))
+}
+
+// receive answers the client once its upload is over.
+func (s *Server) receive(client *ClientConn, err error) {
+	receiver := client.Receiver
+	if !receiver.Done() {
+		return
+	}
+	client.Receiver = nil
+
+	response := "upload complete"
+	if err != nil {
+		fmt.Printf("[%s] upload failed: %v\n", client.Addr, err)
+		response = client.home.Hide(fmt.Sprintf("error: upload failed: %v", err))
+	} else {
+		fmt.Printf("[%s] received %s (%d bytes)\n", client.Addr, receiver.Path, receiver.Received)
+	}
+	if err := tcp.SendData(client.Conn, response); err != nil {
+		fmt.Printf("error sending response to %s: %v\n", client.Addr, err)
+		s.removeClient(client.Fd)
+		return
+	}
+	s.runBufferedCommands(client)
+}
+
+// setInterest changes what the event loop waits for on the client's socket.
+func (s *Server) setInterest(client *ClientConn, interest Interest) {
+	if err := s.Poller.Modify(client.Fd, interest); err != nil {
+		fmt.Printf("error polling %s: %v\n", client.Addr, err)
+		s.removeClient(client.Fd)
+	}
+}
@@ -0,0 +1,61 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+)
+
+// Conn is a connection with a reader and a writer that live as long as it
+// does. Bytes read ahead of one line or frame stay buffered for the next
+// read, so pipelined commands and data sent right behind a command are
+// never lost, and small writes go out together on Flush.
+type Conn struct {
+	net.Conn
+	Reader *bufio.Reader
+	Writer *bufio.Writer
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:   conn,
+		Reader: bufio.NewReader(conn),
+		Writer: bufio.NewWriter(conn),
+	}
+}
+
+// Read reads through the buffer, so it sees read-ahead bytes first.
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// Write buffers p until the buffer fills or Flush is called.
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.Writer.Write(p)
+}
+
+func (c *Conn) Flush() error {
+	return c.Writer.Flush()
+}
+
+// BufferedLine returns the next line if it is already complete in reader's
+// buffer, without reading from the connection.
+func BufferedLine(reader *bufio.Reader) (string, bool) {
+	data, _ := reader.Peek(reader.Buffered())
+	if bytes.IndexByte(data, '\n') < 0 {
+		return "", false
+	}
+	line, _ := reader.ReadString('\n')
+	return strings.TrimSpace(line), true
+}
+
+// ReadMore makes one read from the connection into reader's buffer. Called
+// only once the socket is readable, it does not block.
+func ReadMore(reader *bufio.Reader) error {
+	_, err := reader.Peek(reader.Buffered() + 1)
+	if err == bufio.ErrBufferFull {
+		return nil
+	}
+	return err
+}
@@ -1,8 +1,12 @@
 package tcp
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"os"
@@ -10,33 +14,52 @@ import (
 	"strings"
 	"syscall"
 	"time"
-	"unsafe"
 )
 
 const (
 	Port          = 8000
+	ProgressWidth = 50
+)
+
+// KeepaliveIdle and BufferSize, the largest data frame sent, can be
+// changed in the configuration.
+var (
 	KeepaliveIdle = 30 * time.Second
 	BufferSize    = 128 * 1024
-	ProgressWidth = 50
 )
 
-func GetFd(conn net.Conn) (int, error) {
-	switch c := conn.(type) {
-	case *net.TCPConn:
-		file, err := c.File()
-		if err != nil {
-			return 0, err
-		}
-		return int(file.Fd()), nil
-	case *net.UnixConn:
-		file, err := c.File()
-		if err != nil {
-			return 0, err
-		}
-		return int(file.Fd()), nil
-	default:
+// ShutdownNotice is what a server sends its clients instead of an answer
+// when it is going away.
+const ShutdownNotice = "error: server shutting down"
+
+// HashAlgorithm is the checksum the sender announces in transfer metadata.
+var HashAlgorithm = "sha256"
+
+// Frame types used for the file body that follows the "name|size" metadata line.
+const (
+	FrameData       byte = 'D'
+	FrameEOF        byte = 'E'
+	FrameError      byte = 'X'
+	FrameHeaderSize      = 5
+)
+
+// GetFd returns the descriptor of conn itself rather than a duplicate, so
+// it stays non-blocking and is closed along with conn.
+func GetFd(conn any) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
 		return 0, fmt.Errorf("unsupported connection type")
 	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var fd int
+	err = raw.Control(func(descriptor uintptr) {
+		fd = int(descriptor)
+	})
+	return fd, err
 }
 
 func SetKeepalive(conn net.Conn) error {
@@ -53,17 +76,21 @@ func SetKeepalive(conn net.Conn) error {
 	return nil
 }
 
-func SendData(conn net.Conn, data string) error {
-	if _, err := fmt.Fprintln(conn, data); err != nil {
+// SendData writes one line and flushes it.
+func SendData(conn *Conn, data string) error {
+	if _, err := fmt.Fprintln(conn.Writer, data); err != nil {
+		return fmt.Errorf("error writing to connection: %v", err)
+	}
+	if err := conn.Flush(); err != nil {
 		return fmt.Errorf("error writing to connection: %v", err)
 	}
 	return nil
 }
 
-func ReadData(conn net.Conn) (string, error) {
-	reader := bufio.NewReader(conn)
-
-	data, err := reader.ReadString('\n')
+// ReadData reads one line from the connection's buffered reader, leaving
+// whatever follows it for the next read.
+func ReadData(conn *Conn) (string, error) {
+	data, err := conn.Reader.ReadString('\n')
 	if err != nil {
 		return "", fmt.Errorf("error reading data: %v", err)
 	}
@@ -71,6 +98,32 @@ func ReadData(conn net.Conn) (string, error) {
 	return strings.TrimSpace(data), nil
 }
 
+// WriteFrame writes a 1-byte frame type, a 4-byte big-endian payload length
+// and the payload itself.
+func WriteFrame(w io.Writer, frameType byte, payload []byte) error {
+	header := make([]byte, FrameHeaderSize)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("error writing frame header: %v", err)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	if _, err := w.Write(payload); err != nil {
+		return fmt.Errorf("error writing frame payload: %v", err)
+	}
+	return nil
+}
+
+func ReadFrameHeader(r io.Reader) (byte, uint32, error) {
+	header := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, fmt.Errorf("error reading frame header: %v", err)
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:]), nil
+}
+
 func GetIP() (string, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
@@ -104,130 +157,106 @@ func IsWirelessInterface(name string) bool {
 		name == "Беспроводная сеть"
 }
 
-func Download(localDir string, conn net.Conn, args ...string) {
-	metaData, err := ReadData(conn)
-	if err != nil {
-		fmt.Printf("error receiving metadata: %v\n", err)
-		return
-	}
-	metaParts := strings.Split(metaData, "|")
-	if len(metaParts) != 2 {
-		fmt.Println("error: invalid metadata format")
-		return
-	}
-	fileName := metaParts[0]
-	var fileSize int64
-	_, err = fmt.Sscanf(metaParts[1], "%d", &fileSize)
-	if err != nil {
-		fmt.Printf("error parsing file size: %v\n", err)
-		return
-	}
-	localFilePath := filepath.Join(localDir, fileName)
-	localFilePath = GetUniqueFileName(localFilePath)
+// Download receives one file into localDir and returns the path it was
+// written to, which may differ from the name asked for; see CreateUnique.
+func Download(localDir string, conn *Conn, args ...string) (string, error) {
+	reader := conn.Reader
 
-	file, err := os.Create(localFilePath)
-	if err != nil {
-		fmt.Printf("error creating file: %v\n", err)
-		return
-	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-
-	buffer := make([]byte, BufferSize)
-	var receivedBytes int64
+	receiver := NewFileReceiver(localDir, args...)
 	startTime := time.Now()
-
 	for {
-		n, err := conn.Read(buffer)
-		if err != nil {
-			if n == 0 && err == io.EOF {
-				break
-			}
-			fmt.Printf("error reading data: %v\n", err)
-			return
+		err := receiver.Drain(reader)
+		if receiver.Received > 0 {
+			PrintProgress(receiver.Received, receiver.Size, startTime)
 		}
-		data := string(buffer[:n])
-		if strings.Contains(data, "[EOF]") {
-			eofIndex := strings.Index(data, "[EOF]")
-			_, err = file.Write(buffer[:eofIndex])
+		if receiver.Done() {
+			if receiver.Received > 0 {
+				fmt.Println()
+			}
 			if err != nil {
-				fmt.Printf("error writing to file: %v\n", err)
+				return "", err
 			}
 			break
 		}
-		_, err = file.Write(buffer[:n])
-		if err != nil {
-			fmt.Printf("error writing to file: %v\n", err)
-			return
+		if err := ReadMore(reader); err != nil {
+			receiver.Abort()
+			return "", fmt.Errorf("error receiving file: %v", err)
 		}
-		receivedBytes += int64(n)
-		PrintProgress(receivedBytes, fileSize, startTime)
 	}
 
 	duration := time.Since(startTime)
-	speed := float64(receivedBytes) / duration.Seconds() / 1024 // KB/s
-	fmt.Printf("\ndownload completed: %d bytes in %.2f seconds (%.2f KB/s)\n",
-		receivedBytes, duration.Seconds(), speed)
+	speed := float64(receiver.Received) / duration.Seconds() / 1024 // KB/s
+	fmt.Printf("download completed: %d bytes in %.2f seconds (%.2f KB/s), %s verified\n",
+		receiver.Received, duration.Seconds(), speed, receiver.Algorithm)
+	return receiver.Path, nil
 }
 
-func Upload(localDir string, conn net.Conn, args ...string) {
-	if len(args) == 0 {
-		_ = SendData(conn, "error: file name required")
-		return
-	}
-	localFileName := args[0]
-	localFilePath := filepath.Join(localDir, localFileName)
-	file, err := os.Open(localFilePath)
-	if err != nil {
-		_ = SendData(conn, "error: failed to open file")
-		return
-	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
+func Upload(localDir string, conn *Conn, args ...string) error {
+	defer func() {
+		_ = conn.Flush()
+	}()
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		_ = SendData(conn, "error: failed to get file info")
-		return
-	}
-	totalBytes := fileInfo.Size()
+	sender, _ := NewFileSender(localDir, args...)
+	defer func() {
+		_ = sender.Close()
+	}()
 
-	metaData := fmt.Sprintf("%s|%d", localFileName, totalBytes)
-	err = SendData(conn, metaData)
-	if err != nil {
-		fmt.Printf("error sending metadata: %v\n", err)
-		return
-	}
-
-	buffer := make([]byte, BufferSize)
-	var sentBytes int64
 	startTime := time.Now()
-
-	for {
-		n, err := file.Read(buffer)
+	for !sender.Done() {
+		n, err := conn.Write(sender.Pending())
+		sender.Advance(n)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			fmt.Printf("error reading file: %v\n", err)
-			return
+			return fmt.Errorf("error sending data: %v", err)
 		}
-		_, err = conn.Write(buffer[:n])
-		if err != nil {
-			fmt.Printf("error sending data: %v\n", err)
-			return
+		if sender.Sent > 0 {
+			PrintProgress(sender.Sent, sender.Size, startTime)
 		}
-		sentBytes += int64(n)
-		PrintProgress(sentBytes, totalBytes, startTime)
+	}
+	if sender.Sent > 0 {
+		fmt.Println()
+	}
+	if err := sender.Err(); err != nil {
+		return err
 	}
 
-	_, _ = conn.Write([]byte("[EOF]"))
 	duration := time.Since(startTime)
-	speed := float64(totalBytes) / duration.Seconds() / 1024
-	fmt.Printf("\nupload completed: %d bytes in %.2f seconds (%.2f KB/s)\n",
-		totalBytes, duration.Seconds(), speed)
+	speed := float64(sender.Size) / duration.Seconds() / 1024
+	fmt.Printf("upload completed: %d bytes in %.2f seconds (%.2f KB/s)\n",
+		sender.Size, duration.Seconds(), speed)
+	return nil
+}
+
+// NewHash returns a hasher for one of the checksum algorithms accepted in
+// transfer metadata.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
+
+// HashFile returns the "algorithm:hexdigest" checksum of r.
+func HashFile(r io.Reader, algorithm string) (string, error) {
+	hasher, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return algorithm + ":" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func ParseChecksum(checksum string) (string, string, error) {
+	algorithm, sum, ok := strings.Cut(checksum, ":")
+	if !ok || sum == "" {
+		return "", "", fmt.Errorf("invalid checksum %q", checksum)
+	}
+	return algorithm, strings.ToLower(sum), nil
 }
 
 func PrintProgress(current, total int64, startTime time.Time) {
@@ -249,7 +278,7 @@ func PrintProgress(current, total int64, startTime time.Time) {
 }
 
 func GetUniqueFileName(filePath string) string {
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	if _, err := os.Lstat(filePath); os.IsNotExist(err) {
 		return filePath
 	}
 
@@ -260,9 +289,23 @@ func GetUniqueFileName(filePath string) string {
 	for {
 		newFileName := fmt.Sprintf("%s(%d)%s", base, i, ext)
 		newPath := filepath.Join(dir, newFileName)
-		if _, err := os.Stat(newPath); os.IsNotExist(err) {
+		if _, err := os.Lstat(newPath); os.IsNotExist(err) {
 			return newPath
 		}
 		i++
 	}
 }
+
+// CreateUnique creates a new file at filePath, or under the first free
+// name GetUniqueFileName finds, and returns it with its path. It never
+// opens an entry that is already there, so a symlink in the way, even a
+// dangling one, cannot redirect the file elsewhere.
+func CreateUnique(filePath string) (*os.File, string, error) {
+	for {
+		name := GetUniqueFileName(filePath)
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL|noFollow, 0666)
+		if !os.IsExist(err) {
+			return file, name, err
+		}
+	}
+}
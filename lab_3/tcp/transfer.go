@@ -0,0 +1,353 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileSender produces the byte stream of one file transfer: the
+// "name|size|checksum" metadata line, the data frames and the eof frame. It
+// reads and frames the file a chunk at a time as the previous chunk is
+// written, so a server can drive it from socket readiness without blocking.
+type FileSender struct {
+	Name     string
+	Size     int64
+	Sent     int64 // file bytes framed so far
+	file     *os.File
+	source   io.Reader
+	buffer   []byte
+	pending  []byte
+	finished bool // nothing is left to frame
+	err      error
+}
+
+// NewFileSender opens the file named by args[0] in localDir and queues its
+// metadata. If the file cannot be sent, the error line the receiver expects
+// is queued instead and the returned error says why.
+func NewFileSender(localDir string, args ...string) (*FileSender, error) {
+	s := &FileSender{finished: true}
+	fail := func(reply string, err error) (*FileSender, error) {
+		s.pending = []byte("error: " + reply + "\n")
+		s.err = err
+		return s, err
+	}
+
+	if len(args) == 0 {
+		return fail("file name required", fmt.Errorf("file name required"))
+	}
+	s.Name = args[0]
+	file, err := os.Open(filepath.Join(localDir, s.Name))
+	if err != nil {
+		return fail("failed to open file", fmt.Errorf("failed to open file: %v", err))
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fail("failed to get file info", fmt.Errorf("failed to get file info: %v", err))
+	}
+	s.Size = fileInfo.Size()
+
+	checksum, err := HashFile(io.LimitReader(file, s.Size), HashAlgorithm)
+	if err != nil {
+		_ = file.Close()
+		return fail("failed to hash file", fmt.Errorf("failed to hash file: %v", err))
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		_ = file.Close()
+		return fail("failed to seek file", fmt.Errorf("failed to seek file: %v", err))
+	}
+
+	s.file = file
+	s.source = io.LimitReader(file, s.Size)
+	s.buffer = make([]byte, FrameHeaderSize+BufferSize)
+	s.pending = []byte(fmt.Sprintf("%s|%d|%s\n", s.Name, s.Size, checksum))
+	s.finished = false
+	return s, nil
+}
+
+// RefuseFile returns a sender that only tells the receiver, with err as the
+// reason, that the file will not be sent.
+func RefuseFile(err error) *FileSender {
+	return &FileSender{finished: true, pending: []byte("error: " + err.Error() + "\n"), err: err}
+}
+
+// Pending returns the bytes to write next, framing the next chunk of the
+// file once the previous one has been written. It is empty when the
+// transfer is complete.
+func (s *FileSender) Pending() []byte {
+	if len(s.pending) == 0 && !s.finished {
+		s.next()
+	}
+	return s.pending
+}
+
+// Advance records that the first n pending bytes were written.
+func (s *FileSender) Advance(n int) {
+	s.pending = s.pending[n:]
+}
+
+// Done reports whether everything, including the eof frame, was written.
+func (s *FileSender) Done() bool {
+	return s.finished && len(s.pending) == 0
+}
+
+// Err returns why the file was not sent in full, if it was not. The
+// receiver has been sent an error line or frame in its place.
+func (s *FileSender) Err() error {
+	return s.err
+}
+
+func (s *FileSender) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+func (s *FileSender) next() {
+	n, err := s.source.Read(s.buffer[FrameHeaderSize:])
+	if n > 0 {
+		s.pending = frame(s.buffer, FrameData, n)
+		s.Sent += int64(n)
+		return
+	}
+
+	s.finished = true
+	if err == nil || err == io.EOF {
+		s.pending = frame(s.buffer, FrameEOF, 0)
+		return
+	}
+	s.err = fmt.Errorf("error reading file: %v", err)
+	message := []byte("failed to read file")
+	copy(s.buffer[FrameHeaderSize:], message)
+	s.pending = frame(s.buffer, FrameError, len(message))
+}
+
+// frame fills in the header in front of the n payload bytes already in
+// buffer and returns the whole frame.
+func frame(buffer []byte, frameType byte, n int) []byte {
+	buffer[0] = frameType
+	binary.BigEndian.PutUint32(buffer[1:FrameHeaderSize], uint32(n))
+	return buffer[:FrameHeaderSize+n]
+}
+
+// FileReceiver consumes the byte stream of one file transfer as it arrives
+// and writes the file into its directory. Metadata lines and frame headers
+// split across reads are left unconsumed until the rest arrives. A file
+// that cannot be stored is still consumed to the end, so that the stream
+// stays in step with the sender, and the error is returned then.
+type FileReceiver struct {
+	Name      string // as announced by the sender
+	Path      string // where the file is written
+	Size      int64
+	Received  int64
+	localDir  string
+	localName string
+	Algorithm string
+	expected  string
+	hasher    hash.Hash
+	file      *os.File
+	started   bool  // the metadata has been read
+	refused   error // why the file is being skipped
+	remaining int64 // payload bytes left in the current data frame
+	done      bool
+}
+
+// NewFileReceiver stores the file in localDir under args[0] if it is given,
+// and otherwise under the base of the name the sender announces.
+func NewFileReceiver(localDir string, args ...string) *FileReceiver {
+	r := &FileReceiver{localDir: localDir}
+	if len(args) > 0 {
+		r.localName = args[0]
+	}
+	return r
+}
+
+// Refuse makes the receiver skip the file and fail with err once it has
+// gone by.
+func (r *FileReceiver) Refuse(err error) {
+	r.refused = err
+}
+
+// Feed consumes what it can of p and returns how many bytes it used. After
+// an error the transfer is over and a partial file is removed.
+func (r *FileReceiver) Feed(p []byte) (int, error) {
+	n, err := r.feed(p)
+	if err != nil {
+		r.Abort()
+		r.done = true
+	}
+	return n, err
+}
+
+func (r *FileReceiver) feed(p []byte) (int, error) {
+	consumed := 0
+	if !r.started {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			return 0, nil
+		}
+		if err := r.begin(strings.TrimSpace(string(p[:i]))); err != nil {
+			return i + 1, err
+		}
+		r.started = true
+		consumed = i + 1
+	}
+
+	for !r.done {
+		rest := p[consumed:]
+		if r.remaining > 0 {
+			n := min(r.remaining, int64(len(rest)))
+			if n == 0 {
+				break
+			}
+			if r.file != nil {
+				if _, err := r.file.Write(rest[:n]); err != nil {
+					return consumed, fmt.Errorf("error writing to file: %v", err)
+				}
+				r.hasher.Write(rest[:n])
+			}
+			r.Received += n
+			r.remaining -= n
+			consumed += int(n)
+			continue
+		}
+
+		if len(rest) < FrameHeaderSize {
+			break
+		}
+		frameType, length := rest[0], int64(binary.BigEndian.Uint32(rest[1:FrameHeaderSize]))
+		switch frameType {
+		case FrameData:
+			if r.refused == nil && r.Received+length > r.Size {
+				return consumed, fmt.Errorf("received more than %d announced bytes", r.Size)
+			}
+			r.remaining = length
+			consumed += FrameHeaderSize
+		case FrameEOF:
+			consumed += FrameHeaderSize
+			return consumed, r.finish()
+		case FrameError:
+			if int64(len(rest)) < FrameHeaderSize+length {
+				return consumed, nil
+			}
+			consumed += FrameHeaderSize + int(length)
+			return consumed, fmt.Errorf("error from sender: %s", rest[FrameHeaderSize:FrameHeaderSize+length])
+		default:
+			return consumed, fmt.Errorf("unknown frame type %q", frameType)
+		}
+	}
+	return consumed, nil
+}
+
+// Drain feeds r everything reader has buffered, without reading more.
+func (r *FileReceiver) Drain(reader *bufio.Reader) error {
+	for !r.done && reader.Buffered() > 0 {
+		data, _ := reader.Peek(reader.Buffered())
+		n, err := r.Feed(data)
+		_, _ = reader.Discard(n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if reader.Buffered() == reader.Size() {
+				return fmt.Errorf("metadata or frame does not fit the read buffer")
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// Done reports whether the transfer is over: the eof frame was processed,
+// or Feed failed.
+func (r *FileReceiver) Done() bool {
+	return r.done
+}
+
+// Abort closes and removes a partially received file.
+func (r *FileReceiver) Abort() {
+	if r.file == nil || r.done {
+		return
+	}
+	_ = r.file.Close()
+	_ = os.Remove(r.Path)
+	r.done = true
+}
+
+func (r *FileReceiver) begin(metaData string) error {
+	if strings.HasPrefix(metaData, "error") {
+		return fmt.Errorf("sender: %s", strings.TrimPrefix(metaData, "error: "))
+	}
+	metaParts := strings.Split(metaData, "|")
+	if len(metaParts) != 3 {
+		return fmt.Errorf("invalid metadata format")
+	}
+	r.Name = metaParts[0]
+	// The sender goes on with its frames whatever is wrong with the
+	// metadata, so from here on the file is refused rather than the
+	// transfer ended, and the stream is read to its end.
+	if _, err := fmt.Sscanf(metaParts[1], "%d", &r.Size); err != nil {
+		r.refused = fmt.Errorf("error parsing file size: %v", err)
+		return nil
+	}
+
+	var err error
+	r.Algorithm, r.expected, err = ParseChecksum(metaParts[2])
+	if err == nil {
+		r.hasher, err = NewHash(r.Algorithm)
+	}
+	if err != nil {
+		r.refused = err
+		return nil
+	}
+
+	if r.refused != nil {
+		return nil
+	}
+	// The announced name is only ever a base name: it must not place the
+	// file outside localDir.
+	name := path.Base(strings.ReplaceAll(r.Name, "\\", "/"))
+	if r.localName != "" {
+		name = r.localName
+	}
+	if name == "." || name == ".." || name == "/" {
+		r.refused = fmt.Errorf("invalid file name %q", r.Name)
+		return nil
+	}
+	r.file, r.Path, err = CreateUnique(filepath.Join(r.localDir, name))
+	if err != nil {
+		r.refused = fmt.Errorf("error creating file: %v", err)
+	}
+	return nil
+}
+
+func (r *FileReceiver) finish() error {
+	r.done = true
+	if r.refused != nil {
+		return r.refused
+	}
+	if err := r.file.Close(); err != nil {
+		_ = os.Remove(r.Path)
+		return fmt.Errorf("error writing to file: %v", err)
+	}
+	if r.Received != r.Size {
+		_ = os.Remove(r.Path)
+		return fmt.Errorf("incomplete transfer, received %d of %d bytes, removed %s", r.Received, r.Size, r.Path)
+	}
+	if actualSum := hex.EncodeToString(r.hasher.Sum(nil)); actualSum != r.expected {
+		_ = os.Remove(r.Path)
+		return fmt.Errorf("%s checksum mismatch, removed %s", r.Algorithm, r.Path)
+	}
+	return nil
+}
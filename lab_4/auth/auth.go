@@ -0,0 +1,162 @@
+// Package auth checks client logins against a users file. Each line of the
+// file holds one user as "name:bcrypt-hash:role:home"; blank lines and
+// lines starting with '#' are skipped. The role is "ro", read-only, or
+// "rw", read-write, and home is the user's directory under the server
+// root, which becomes the root of everything the user sees.
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role says what a user may do.
+type Role string
+
+const (
+	ReadOnly  Role = "ro"
+	ReadWrite Role = "rw"
+)
+
+// ErrBadLogin is returned for an unknown user and a wrong password alike.
+var ErrBadLogin = errors.New("invalid user name or password")
+
+type User struct {
+	Name string
+	Role Role
+	Home string
+	hash []byte
+}
+
+// CanWrite reports whether the user may change files.
+func (u *User) CanWrite() bool {
+	return u.Role == ReadWrite
+}
+
+type Users struct {
+	users map[string]*User
+}
+
+// Load reads the users file at path.
+func Load(path string) (*Users, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading users: %v", err)
+	}
+	defer file.Close()
+
+	u := &Users{users: make(map[string]*User)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, err := parseUser(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		u.users[user.Name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading users: %v", err)
+	}
+	return u, nil
+}
+
+// Len returns the number of users.
+func (u *Users) Len() int {
+	return len(u.users)
+}
+
+// Authenticate checks a login. An unknown user costs as much time as a
+// wrong password, so the answer does not tell whether the name exists.
+func (u *Users) Authenticate(name, password string) (*User, error) {
+	user, ok := u.users[name]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, ErrBadLogin
+	}
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(password)) != nil {
+		return nil, ErrBadLogin
+	}
+	return user, nil
+}
+
+// AddUser sets the password, role and home of name in the users file at
+// path, adding the user if needed and creating the file if it is missing.
+func AddUser(filePath, name, password string, role Role, home string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %v", err)
+	}
+	user := &User{Name: name, Role: role, Home: path.Clean("/" + home), hash: hash}
+	if err := user.validate(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading users: %v", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if fields := strings.SplitN(line, ":", 2); line != "" && fields[0] != name {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, user.String())
+	if err := os.WriteFile(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("error writing users: %v", err)
+	}
+	return nil
+}
+
+func (u *User) String() string {
+	return strings.Join([]string{u.Name, string(u.hash), string(u.Role), u.Home}, ":")
+}
+
+func parseUser(line string) (*User, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("want name:hash:role:home")
+	}
+	user := &User{Name: fields[0], hash: []byte(fields[1]), Role: Role(fields[2]), Home: fields[3]}
+	if _, err := bcrypt.Cost(user.hash); err != nil {
+		return nil, fmt.Errorf("bad password hash for %s: %v", user.Name, err)
+	}
+	return user, user.validate()
+}
+
+func (u *User) validate() error {
+	if u.Name == "" || strings.ContainsAny(u.Name, ": \t") {
+		return fmt.Errorf("invalid user name %q", u.Name)
+	}
+	if u.Role != ReadOnly && u.Role != ReadWrite {
+		return fmt.Errorf("role must be %q or %q", ReadOnly, ReadWrite)
+	}
+	if !strings.HasPrefix(u.Home, "/") || strings.Contains(u.Home, ":") {
+		return fmt.Errorf("home must be an absolute path under the server root")
+	}
+	return nil
+}
+
+var (
+	dummy     []byte
+	dummyOnce sync.Once
+)
+
+// dummyHash is compared against for unknown users.
+func dummyHash() []byte {
+	dummyOnce.Do(func() {
+		dummy, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	})
+	return dummy
+}
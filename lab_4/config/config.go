@@ -0,0 +1,198 @@
+// Package config holds the settings of the server and the client. They
+// come from built-in defaults, an optional JSON file and NSSDS_*
+// environment variables, each overriding the one before; command-line
+// flags, applied by main, override them all.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// EnvFile names the config file when no -config flag is given.
+const EnvFile = "NSSDS_CONFIG"
+
+type Config struct {
+	Server Server `json:"server"`
+	Client Client `json:"client"`
+	// Keepalive and BufferSize apply to the connections of both sides.
+	Keepalive  Duration `json:"keepalive" env:"NSSDS_KEEPALIVE"`
+	BufferSize int      `json:"buffer_size" env:"NSSDS_BUFFER_SIZE"`
+}
+
+type Server struct {
+	Listen       string   `json:"listen" env:"NSSDS_LISTEN"`
+	Root         string   `json:"root" env:"NSSDS_ROOT"`
+	DrainTimeout Duration `json:"drain_timeout" env:"NSSDS_DRAIN_TIMEOUT"`
+	// The client pool; see server.PoolConfig.
+	MinWorkers  int      `json:"min_workers" env:"NSSDS_MIN_WORKERS"`
+	MaxWorkers  int      `json:"max_workers" env:"NSSDS_MAX_WORKERS"`
+	QueueDepth  int      `json:"queue_depth" env:"NSSDS_QUEUE_DEPTH"`
+	IdleTimeout Duration `json:"idle_timeout" env:"NSSDS_IDLE_TIMEOUT"`
+	// Users is the users file (see package auth). Without one, clients
+	// need no login and may read and write everything under Root.
+	Users string `json:"users" env:"NSSDS_USERS"`
+	// With TLSCert and TLSKey set, the server speaks only TLS. With
+	// TLSClientCA set too, clients need a certificate signed by it.
+	TLSCert     string `json:"tls_cert" env:"NSSDS_TLS_CERT"`
+	TLSKey      string `json:"tls_key" env:"NSSDS_TLS_KEY"`
+	TLSClientCA string `json:"tls_client_ca" env:"NSSDS_TLS_CLIENT_CA"`
+}
+
+type Client struct {
+	// Addr is the server to connect to. If it is empty, the client asks.
+	Addr string `json:"addr" env:"NSSDS_ADDR"`
+	Dir  string `json:"dir" env:"NSSDS_DIR"`
+	// User and Password, if set, log the client in on connecting. The
+	// password is better kept in the environment than in the file.
+	User     string `json:"user" env:"NSSDS_USER"`
+	Password string `json:"password" env:"NSSDS_PASSWORD"`
+	// TLS connects over TLS; setting TLSCA or TLSPin implies it. See
+	// tcp.ClientTLS for how the server's certificate is checked.
+	TLS        bool   `json:"tls" env:"NSSDS_TLS"`
+	TLSCA      string `json:"tls_ca" env:"NSSDS_TLS_CA"`
+	TLSPin     string `json:"tls_pin" env:"NSSDS_TLS_PIN"`
+	TLSCert    string `json:"tls_cert" env:"NSSDS_CLIENT_CERT"`
+	TLSKey     string `json:"tls_key" env:"NSSDS_CLIENT_KEY"`
+	KnownHosts string `json:"known_hosts" env:"NSSDS_KNOWN_HOSTS"`
+}
+
+// UsesTLS reports whether the client connects over TLS.
+func (c Client) UsesTLS() bool {
+	return c.TLS || c.TLSCA != "" || c.TLSPin != ""
+}
+
+func Default() Config {
+	return Config{
+		Server: Server{
+			Listen:       "127.0.0.1:8000",
+			Root:         ".",
+			DrainTimeout: Duration(30 * time.Second),
+			MinWorkers:   4,
+			MaxWorkers:   32,
+			QueueDepth:   64,
+			IdleTimeout:  Duration(10 * time.Minute),
+		},
+		Client: Client{
+			Dir: ".",
+		},
+		Keepalive:  Duration(30 * time.Second),
+		BufferSize: 128 * 1024,
+	}
+}
+
+// Load returns the defaults overridden by the file at path, if path is not
+// empty, and then by the environment.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("error reading config: %v", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("error parsing config %s: %v", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem()); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the settings that cannot be fixed up with a default.
+func (c Config) Validate() error {
+	if c.BufferSize <= 0 {
+		return fmt.Errorf("buffer_size must be positive")
+	}
+	if c.Keepalive <= 0 {
+		return fmt.Errorf("keepalive must be positive")
+	}
+	if c.Server.MinWorkers < 0 || c.Server.MaxWorkers <= 0 || c.Server.MinWorkers > c.Server.MaxWorkers {
+		return fmt.Errorf("need 0 <= min_workers <= max_workers and max_workers > 0")
+	}
+	if c.Server.QueueDepth < 0 {
+		return fmt.Errorf("queue_depth must not be negative")
+	}
+	if c.Server.IdleTimeout <= 0 {
+		return fmt.Errorf("idle_timeout must be positive")
+	}
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		return fmt.Errorf("server tls_cert and tls_key must be set together")
+	}
+	if c.Server.TLSClientCA != "" && c.Server.TLSCert == "" {
+		return fmt.Errorf("server tls_client_ca needs tls_cert and tls_key")
+	}
+	if (c.Client.TLSCert == "") != (c.Client.TLSKey == "") {
+		return fmt.Errorf("client tls_cert and tls_key must be set together")
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// applyEnv sets every field tagged with env whose variable is set.
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, info := v.Field(i), v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+		name := info.Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+
+		switch {
+		case field.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.SetInt(int64(n))
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		}
+	}
+	return nil
+}
+
+// Duration is a time.Duration written as a string such as "30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -1,3 +1,5 @@
 module lab_4
 
 go 1.24.2
+
+require golang.org/x/crypto v0.22.0
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"lab_4/auth"
+	"strings"
+)
+
+const (
+	// MaxLoginAttempts is how many failed logins a client gets before it
+	// is disconnected.
+	MaxLoginAttempts = 3
+	LoginLimitNotice = "error: too many failed logins"
+)
+
+// writeCommands change files, so they need the read-write role.
+var writeCommands = map[string]bool{
+	"upload": true,
+	"mkdir":  true,
+	"rm":     true,
+	"rmdir":  true,
+	"mv":     true,
+	"rename": true,
+	"cp":     true,
+}
+
+// authorize returns the error to answer cmd with, or "" if user may run
+// it. Before logging in, a client may only log in or leave. Without a
+// users file every client may run everything.
+func authorize(users *auth.Users, user *auth.User, cmd string) string {
+	if users == nil {
+		return ""
+	}
+	switch {
+	case cmd == "login", cmd == "quit", cmd == "exit", cmd == "close":
+		return ""
+	case user == nil:
+		return "error: login required"
+	case writeCommands[cmd] && !user.CanWrite():
+		return "error: permission denied, read-only user"
+	}
+	return ""
+}
+
+// login checks "login <name> <password>" and returns the user with a jail
+// rooted at their home directory.
+func login(users *auth.Users, root *Jail, args []string) (*auth.User, *Jail, error) {
+	if len(args) != 2 {
+		return nil, nil, fmt.Errorf("usage: login <name> <password>")
+	}
+	user, err := users.Authenticate(args[0], args[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	home, err := root.Home(user.Home)
+	if err != nil {
+		return nil, nil, fmt.Errorf("home directory of %s is unavailable", user.Name)
+	}
+	return user, home, nil
+}
+
+// announceUsers tells the operator whether clients have to log in.
+func announceUsers(users *auth.Users) {
+	if users == nil {
+		fmt.Println("warning: no users file, clients have read-write access without logging in")
+		return
+	}
+	fmt.Printf("%d users, login required\n", users.Len())
+}
+
+// redact hides the password of a login command from the log.
+func redact(command string) string {
+	parts := strings.Fields(command)
+	if len(parts) > 2 && strings.ToLower(parts[0]) == "login" {
+		return parts[0] + " " + parts[1] + " ***"
+	}
+	return command
+}
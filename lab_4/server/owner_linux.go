@@ -0,0 +1,23 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// fileOwner names the owner of a file as "name (uid)", or by uid alone if
+// it has no account here.
+func fileOwner(info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	uid := strconv.FormatUint(uint64(stat.Uid), 10)
+	if owner, err := user.LookupId(uid); err == nil {
+		return fmt.Sprintf("%s (%s)", owner.Username, uid)
+	}
+	return uid
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package server
+
+import "os"
+
+// fileOwner is not known off Linux.
+func fileOwner(info os.FileInfo) string {
+	return ""
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"lab_4/auth"
+	"lab_4/tcp"
+	"sync"
+	"time"
+)
+
+// NoticeTimeout bounds writes of notices to clients no worker is serving,
+// so one that is not reading holds up little more than itself.
+const NoticeTimeout = 100 * time.Millisecond
+
+// PoolConfig sizes the client pool. MinWorkers stay up while idle; more
+// are started as clients arrive, up to MaxWorkers, and stop again once the
+// queue is empty. Past that, up to QueueDepth clients wait in line and the
+// rest are turned away. A client that sends no command for IdleTimeout is
+// disconnected so it does not hold a worker forever.
+type PoolConfig struct {
+	MinWorkers  int
+	MaxWorkers  int
+	QueueDepth  int
+	IdleTimeout time.Duration
+}
+
+var DefaultPoolConfig = PoolConfig{
+	MinWorkers:  4,
+	MaxWorkers:  32,
+	QueueDepth:  64,
+	IdleTimeout: 10 * time.Minute,
+}
+
+// PoolStats counts the pool's connections.
+type PoolStats struct {
+	Workers  int
+	Active   int
+	Queued   int
+	Rejected int
+}
+
+func (s PoolStats) String() string {
+	return fmt.Sprintf("%d active, %d queued, %d rejected (%d workers)", s.Active, s.Queued, s.Rejected, s.Workers)
+}
+
+type ClientPool struct {
+	Config  PoolConfig
+	Jail    *Jail
+	Users   *auth.Users
+	Wg      sync.WaitGroup
+	queue   []*waiter
+	clients *clientSet
+	stats   PoolStats
+	stopped bool
+	wake    *sync.Cond
+	mu      sync.Mutex
+}
+
+// NewClientPool fills in an unset MaxWorkers and idle timeout from
+// DefaultPoolConfig. A MinWorkers of 0 keeps no worker while idle: each
+// is started when a client arrives. A QueueDepth of 0 means no client
+// waits: when every worker is busy, new ones are rejected. With users set,
+// clients must log in before anything else.
+func NewClientPool(config PoolConfig, jail *Jail, users *auth.Users) *ClientPool {
+	if config.MaxWorkers <= 0 {
+		config.MaxWorkers = DefaultPoolConfig.MaxWorkers
+	}
+	config.MinWorkers = min(max(config.MinWorkers, 0), config.MaxWorkers)
+	if config.QueueDepth < 0 {
+		config.QueueDepth = 0
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultPoolConfig.IdleTimeout
+	}
+
+	p := &ClientPool{Config: config, Jail: jail, Users: users, clients: newClientSet()}
+	p.wake = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *ClientPool) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := 0; i < p.Config.MinWorkers; i++ {
+		p.startWorker()
+	}
+}
+
+// Submit hands conn to a free worker, starting one if the pool may grow,
+// or else queues it and tells the client its place in line. It never
+// blocks, so the accept loop keeps going however busy the pool is.
+func (p *ClientPool) Submit(conn *tcp.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w := newWaiter(conn)
+	free := p.stats.Workers - p.stats.Active - len(p.queue)
+	switch {
+	case p.stopped:
+		p.reject(w, tcp.ShutdownNotice)
+		return
+	case free > 0:
+	case p.stats.Workers < p.Config.MaxWorkers:
+		p.startWorker()
+	case len(p.queue) < p.Config.QueueDepth:
+		position := len(p.queue) + 1 - (p.stats.Workers - p.stats.Active)
+		w.post(fmt.Sprintf("server busy, position %d in queue", position))
+	default:
+		p.reject(w, "error: server busy, try again later")
+		fmt.Printf("rejected %s: %s\n", conn.RemoteAddr(), p.statsLocked())
+		return
+	}
+
+	p.queue = append(p.queue, w)
+	p.wake.Signal()
+}
+
+func (p *ClientPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Queued = len(p.queue)
+	return stats
+}
+
+// Stop turns away queued clients and waits for the ones being served.
+func (p *ClientPool) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	queued := p.queue
+	for _, w := range queued {
+		p.reject(w, tcp.ShutdownNotice)
+	}
+	p.queue = nil
+	p.wake.Broadcast()
+	p.mu.Unlock()
+
+	for _, w := range queued {
+		<-w.done
+	}
+	p.Wg.Wait()
+}
+
+func (p *ClientPool) startWorker() {
+	p.stats.Workers++
+	p.Wg.Add(1)
+	go p.worker()
+}
+
+// worker serves queued clients one at a time. Workers above MinWorkers
+// stop as soon as the queue is empty.
+func (p *ClientPool) worker() {
+	defer p.Wg.Done()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for len(p.queue) == 0 {
+			if p.stopped || p.stats.Workers > p.Config.MinWorkers {
+				p.stats.Workers--
+				return
+			}
+			p.wake.Wait()
+		}
+
+		w := p.queue[0]
+		p.queue = p.queue[1:]
+		p.stats.Active++
+		w.release()
+		p.updatePositions()
+		conn := w.conn
+		fmt.Printf("serving %s: %s\n", conn.RemoteAddr(), p.statsLocked())
+
+		p.mu.Unlock()
+		// The client reads its queue notices before "ready", so the last
+		// of them goes out before the worker takes the connection over.
+		<-w.done
+		handleClient(conn, p.Jail, p.Users, p.Config.IdleTimeout, p.clients)
+		p.mu.Lock()
+
+		p.stats.Active--
+		fmt.Printf("finished %s: %s\n", conn.RemoteAddr(), p.statsLocked())
+	}
+}
+
+// updatePositions tells every client still waiting where it now stands.
+// The first ones in line are about to be taken by free workers and are
+// left alone.
+func (p *ClientPool) updatePositions() {
+	free := p.stats.Workers - p.stats.Active
+	for i, w := range p.queue {
+		if position := i + 1 - free; position > 0 {
+			w.post(fmt.Sprintf("server busy, position %d in queue", position))
+		}
+	}
+}
+
+func (p *ClientPool) statsLocked() PoolStats {
+	stats := p.stats
+	stats.Queued = len(p.queue)
+	return stats
+}
+
+func (p *ClientPool) reject(w *waiter, message string) {
+	p.stats.Rejected++
+	w.turnAway(message)
+}
+
+// waiter is a client in the queue. Its notices are written by a goroutine
+// of its own rather than under the pool's lock, so a client that does not
+// read them cannot stall the accept loop or the workers. Only the latest
+// notice waits to be sent, as it supersedes any earlier one. The pool's
+// lock orders the calls to post, release and turnAway.
+type waiter struct {
+	conn    *tcp.Conn
+	notices chan string
+	done    chan struct{} // closed once the last notice is written
+	closing bool          // close conn after the last notice
+}
+
+func newWaiter(conn *tcp.Conn) *waiter {
+	w := &waiter{conn: conn, notices: make(chan string, 1), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *waiter) run() {
+	defer close(w.done)
+	for message := range w.notices {
+		notice(w.conn, message)
+	}
+	if w.closing {
+		_ = w.conn.Close()
+	}
+}
+
+// post queues message in place of a notice not yet written.
+func (w *waiter) post(message string) {
+	select {
+	case <-w.notices:
+	default:
+	}
+	w.notices <- message
+}
+
+// release ends the notices; once done is closed, conn is the worker's.
+func (w *waiter) release() {
+	close(w.notices)
+}
+
+// turnAway sends message as the last notice and closes the connection.
+func (w *waiter) turnAway(message string) {
+	w.post(message)
+	w.closing = true
+	close(w.notices)
+}
+
+// notice sends a line to a client no worker is serving.
+func notice(conn *tcp.Conn, message string) {
+	_ = conn.SetWriteDeadline(time.Now().Add(NoticeTimeout))
+	_ = tcp.SendData(conn, message)
+	_ = conn.SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"lab_4/tcp"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPool serves a started pool on a loopback listener.
+type testPool struct {
+	*ClientPool
+	t        *testing.T
+	listener net.Listener
+}
+
+func newTestPool(t *testing.T, config PoolConfig) *testPool {
+	t.Helper()
+	jail, err := NewJail(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	pool := NewClientPool(config, jail, nil)
+	pool.Start()
+	return &testPool{ClientPool: pool, t: t, listener: listener}
+}
+
+// connect dials the pool and submits the server side of the connection,
+// as the accept loop would, so clients are submitted in the order they
+// connect.
+func (p *testPool) connect() *tcp.Conn {
+	p.t.Helper()
+	client, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.t.Cleanup(func() { client.Close() })
+	server, err := p.listener.Accept()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.Submit(tcp.NewConn(server))
+	return tcp.NewConn(client)
+}
+
+// expect reads the next line from conn and checks that it is want.
+func expect(t *testing.T, conn *tcp.Conn, want string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := tcp.ReadData(conn)
+	if err != nil {
+		t.Fatalf("waiting for %q: %v", want, err)
+	}
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// expectClosed checks that the server has closed conn.
+func expectClosed(t *testing.T, conn *tcp.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := tcp.ReadData(conn); !errors.Is(err, io.EOF) {
+		t.Fatalf("read %q, %v from a connection that should be closed", line, err)
+	}
+}
+
+// waitStats waits for the pool's counters to settle at want.
+func waitStats(t *testing.T, pool *ClientPool, want PoolStats) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Stats() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats are %+v, want %+v", pool.Stats(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolQueuesAndRejects(t *testing.T) {
+	pool := newTestPool(t, PoolConfig{MinWorkers: 0, MaxWorkers: 2, QueueDepth: 2})
+
+	first, second := pool.connect(), pool.connect()
+	expect(t, first, "ready")
+	expect(t, second, "ready")
+
+	third, fourth := pool.connect(), pool.connect()
+	expect(t, third, "server busy, position 1 in queue")
+	expect(t, fourth, "server busy, position 2 in queue")
+
+	fifth := pool.connect()
+	expect(t, fifth, "error: server busy, try again later")
+	expectClosed(t, fifth)
+	waitStats(t, pool.ClientPool, PoolStats{Workers: 2, Active: 2, Queued: 2, Rejected: 1})
+
+	// A worker that frees up takes the head of the queue, and everyone
+	// behind it moves up.
+	first.Close()
+	expect(t, third, "ready")
+	expect(t, fourth, "server busy, position 1 in queue")
+	waitStats(t, pool.ClientPool, PoolStats{Workers: 2, Active: 2, Queued: 1, Rejected: 1})
+
+	second.Close()
+	expect(t, fourth, "ready")
+
+	// With the queue empty, workers above MinWorkers stop as they finish.
+	third.Close()
+	fourth.Close()
+	waitStats(t, pool.ClientPool, PoolStats{Rejected: 1})
+
+	// And the pool grows again for the next client.
+	sixth := pool.connect()
+	expect(t, sixth, "ready")
+	sixth.Close()
+	pool.Stop()
+}
+
+func TestPoolWithoutQueue(t *testing.T) {
+	pool := newTestPool(t, PoolConfig{MinWorkers: 1, MaxWorkers: 1, QueueDepth: 0})
+
+	first := pool.connect()
+	expect(t, first, "ready")
+	second := pool.connect()
+	expect(t, second, "error: server busy, try again later")
+	expectClosed(t, second)
+
+	// MinWorkers stay up while idle.
+	first.Close()
+	waitStats(t, pool.ClientPool, PoolStats{Workers: 1, Rejected: 1})
+	pool.Stop()
+	waitStats(t, pool.ClientPool, PoolStats{Rejected: 1})
+}
+
+func TestPoolStopTurnsAwayQueue(t *testing.T) {
+	pool := newTestPool(t, PoolConfig{MinWorkers: 1, MaxWorkers: 1, QueueDepth: 4})
+
+	served := pool.connect()
+	expect(t, served, "ready")
+	queued := pool.connect()
+	expect(t, queued, "server busy, position 1 in queue")
+
+	stopped := make(chan struct{})
+	go func() {
+		pool.Stop()
+		close(stopped)
+	}()
+	expect(t, queued, tcp.ShutdownNotice)
+	expectClosed(t, queued)
+
+	// Stop waits for the clients being served.
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while a client was being served")
+	case <-time.After(50 * time.Millisecond):
+	}
+	served.Close()
+	<-stopped
+
+	late := pool.connect()
+	expect(t, late, tcp.ShutdownNotice)
+	expectClosed(t, late)
+}
@@ -1,58 +1,34 @@
 package server
 
 import (
-	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"lab_4/auth"
 	"lab_4/tcp"
 	"net"
 	"os"
-	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 )
 
+// Server accepts clients and hands them to a pool of workers sized by
+// PoolConfig (see NewClientPool for the defaults). It listens on
+// ServerAddr, 127.0.0.1 and tcp.Port if empty, and serves Root, the
+// working directory if empty. Clients cannot leave Root: they see it as
+// "/". With Users set, clients must log in, and then see only their home
+// directory. With TLS set, every connection starts with a TLS handshake.
 type Server struct {
 	Listener   net.Listener
 	ServerAddr string
-	CurrentDir string
+	Root       string
+	Users      *auth.Users
+	TLS        *tls.Config
+	jail       *Jail
+	PoolConfig PoolConfig
 	ClientPool *ClientPool
 }
 
-type ClientPool struct {
-	Workers    int
-	JobQueue   chan net.Conn
-	Wg         sync.WaitGroup
-	CurrentDir string
-}
-
-func NewClientPool(workers int, dir string) *ClientPool {
-	return &ClientPool{
-		Workers:    workers,
-		JobQueue:   make(chan net.Conn),
-		CurrentDir: dir,
-	}
-}
-
-func (p *ClientPool) Start() {
-	for i := 0; i < p.Workers; i++ {
-		p.Wg.Add(1)
-		go p.worker()
-	}
-}
-
-func (p *ClientPool) worker() {
-	defer p.Wg.Done()
-	for conn := range p.JobQueue {
-		handleClient(conn, p.CurrentDir)
-	}
-}
-
-func (p *ClientPool) Stop() {
-	close(p.JobQueue)
-	p.Wg.Wait()
-}
-
 func (s *Server) RunServer() {
 	address, err := tcp.GetIP()
 	if err != nil {
@@ -60,8 +36,14 @@ func (s *Server) RunServer() {
 		return
 	}
 
-	s.CurrentDir, _ = os.Getwd()
-	s.ServerAddr = fmt.Sprintf("127.0.0.1:%d", tcp.Port)
+	s.jail, err = NewJail(s.Root)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	if s.ServerAddr == "" {
+		s.ServerAddr = fmt.Sprintf("127.0.0.1:%d", tcp.Port)
+	}
 	s.Listener, err = net.Listen("tcp", s.ServerAddr)
 	if err != nil {
 		fmt.Printf("error starting server: %v\n", err)
@@ -69,15 +51,22 @@ func (s *Server) RunServer() {
 	}
 
 	defer s.Listener.Close()
-	fmt.Printf("server started on address %s and port %d\n", address, tcp.Port)
+	fmt.Printf("server started on address %s, listening on %s, serving %s\n", address, s.Listener.Addr(), s.jail.Root)
+	announceUsers(s.Users)
+	announceTLS(s.TLS)
 
-	// Create client pool with 10 workers
-	s.ClientPool = NewClientPool(10, s.CurrentDir)
+	s.ClientPool = NewClientPool(s.PoolConfig, s.jail, s.Users)
 	s.ClientPool.Start()
-	defer s.ClientPool.Stop()
+	fmt.Printf("client pool: %d to %d workers, queue of %d, idle timeout %s\n",
+		s.ClientPool.Config.MinWorkers, s.ClientPool.Config.MaxWorkers,
+		s.ClientPool.Config.QueueDepth, s.ClientPool.Config.IdleTimeout)
+	go s.awaitShutdown()
 
 	for {
 		conn, err := s.Listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
 			fmt.Printf("error accepting connection: %v\n", err)
 			continue
@@ -89,11 +78,34 @@ func (s *Server) RunServer() {
 			continue
 		}
 
-		s.ClientPool.JobQueue <- conn
+		if s.TLS != nil {
+			// Off the accept loop, so a slow handshake holds up no one
+			// else.
+			go s.submitTLS(conn)
+			continue
+		}
+		s.ClientPool.Submit(tcp.NewConn(conn))
+	}
+
+	s.ClientPool.Stop()
+	fmt.Printf("server stopped: %s\n", s.ClientPool.Stats())
+}
+
+// submitTLS hands conn to the pool once its TLS handshake is done.
+func (s *Server) submitTLS(conn net.Conn) {
+	tlsConn, err := tcp.ServerHandshake(conn, s.TLS)
+	if err != nil {
+		fmt.Printf("connection from %s refused: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
 	}
+	s.ClientPool.Submit(tcp.NewConn(tlsConn))
 }
 
-func handleClient(conn net.Conn, currentDir string) {
+// handleClient serves one client until it quits, disconnects or stays
+// silent for idleTimeout. The "ready" greeting tells the client it has a
+// worker, after any queue notices it was sent while waiting.
+func handleClient(conn *tcp.Conn, jail *Jail, users *auth.Users, idleTimeout time.Duration, clients *clientSet) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Printf("recovered from panic in client handler: %v\n", r)
@@ -102,50 +114,95 @@ func handleClient(conn net.Conn, currentDir string) {
 	}()
 
 	clientAddr := conn.RemoteAddr().String()
-	fmt.Printf("new connection from %s\n", clientAddr)
+	fmt.Printf("new connection from %s%s\n", clientAddr, peer(conn))
 
 	client := &ClientConn{
 		Conn:       conn,
 		Addr:       clientAddr,
-		CurrentDir: currentDir,
+		Jail:       jail,
+		Users:      users,
+		CurrentDir: "/",
+		home:       jail,
+	}
+	if !clients.add(conn) {
+		return
+	}
+	defer clients.remove(conn)
+	if err := tcp.SendData(conn, "ready"); err != nil {
+		fmt.Printf("client %s disconnected while queued: %v\n", clientAddr, err)
+		return
 	}
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		command := scanner.Text()
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		command, err := tcp.ReadData(client.Conn)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				fmt.Printf("client %s idle for %s, disconnecting\n", clientAddr, idleTimeout)
+			} else {
+				fmt.Printf("client %s disconnected: %v\n", clientAddr, err)
+			}
+			return
+		}
+		// Transfers may take longer than the idle timeout.
+		_ = conn.SetReadDeadline(time.Time{})
 		parts := strings.Fields(command)
 		if len(parts) == 0 {
 			continue
 		}
-		fmt.Printf("[%s] command: %s\n", clientAddr, command)
+		if !clients.begin(conn) {
+			return
+		}
+		fmt.Printf("[%s] command: %s\n", clientAddr, redact(command))
 		response := client.ParseCommand(parts)
 		if response != "" {
-			if err := tcp.SendData(conn, response); err != nil {
+			if err := tcp.SendData(client.Conn, response); err != nil {
 				fmt.Printf("error sending response to %s: %v\n", clientAddr, err)
 				return
 			}
-			if response == "goodbye!" {
+			if response == "goodbye!" || response == LoginLimitNotice {
 				return
 			}
 		}
-	}
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("client %s disconnected with error: %v\n", clientAddr, err)
+		if !clients.end(conn) {
+			return
+		}
 	}
 }
 
+// ClientConn is one client being served. CurrentDir is its directory in
+// the virtual tree that Jail maps onto the server root, or, once it has
+// logged in, onto its home directory.
 type ClientConn struct {
-	Conn       net.Conn
+	Conn       *tcp.Conn
 	Addr       string
+	Jail       *Jail
+	Users      *auth.Users
 	CurrentDir string
+
+	// The logged-in user, the jail of its home and how many logins the
+	// client has failed.
+	user     *auth.User
+	home     *Jail
+	failures int
 }
 
 func (c *ClientConn) ParseCommand(parts []string) string {
 	cmd := strings.ToLower(parts[0])
 	args := parts[1:]
 
+	if denied := authorize(c.Users, c.user, cmd); denied != "" {
+		if cmd == "upload" {
+			_ = tcp.Discard(c.Conn)
+		}
+		return denied
+	}
+
 	response := ""
 	switch cmd {
+	case "login":
+		response = c.handleLogin(args...)
 	case "echo":
 		response = handleEcho(args...)
 	case "time":
@@ -153,19 +210,71 @@ func (c *ClientConn) ParseCommand(parts []string) string {
 	case "quit", "exit", "close":
 		response = "goodbye!"
 	case "ls":
-		response = handleLs(c.CurrentDir)
+		response = handleLs(c.home, c.CurrentDir)
 	case "cd":
-		response = handleCd(&c.CurrentDir, args...)
+		response = handleCd(c.home, &c.CurrentDir, args...)
+	case "pwd":
+		response = handlePwd(c.CurrentDir)
+	case "mkdir":
+		response = handleMkdir(c.home, c.CurrentDir, args...)
+	case "rm":
+		response = handleRm(c.home, c.CurrentDir, args...)
+	case "rmdir":
+		response = handleRmdir(c.home, c.CurrentDir, args...)
+	case "mv", "rename":
+		response = handleMv(c.home, c.CurrentDir, args...)
+	case "cp":
+		response = handleCp(c.home, c.CurrentDir, args...)
+	case "stat":
+		response = handleStat(c.home, c.CurrentDir, args...)
 	case "download":
-		tcp.Upload(c.CurrentDir, c.Conn, args...)
+		dir, args, err := c.home.fileArgs(c.CurrentDir, args)
+		if err != nil {
+			fmt.Printf("[%s] download refused: %v\n", c.Addr, err)
+			_ = tcp.SendData(c.Conn, fmt.Sprintf("error: %v", err))
+			break
+		}
+		if err := tcp.Upload(dir, c.Conn, args...); err != nil {
+			fmt.Printf("[%s] download failed: %v\n", c.Addr, err)
+		}
 	case "upload":
-		tcp.Download(c.CurrentDir, c.Conn, args...)
+		response = "upload complete"
+		dir, args, err := c.home.fileArgs(c.CurrentDir, args)
+		if err != nil {
+			fmt.Printf("[%s] upload refused: %v\n", c.Addr, err)
+			_ = tcp.Discard(c.Conn)
+			response = fmt.Sprintf("error: upload failed: %v", err)
+			break
+		}
+		if _, err := tcp.Download(dir, c.Conn, args...); err != nil {
+			fmt.Printf("[%s] upload failed: %v\n", c.Addr, err)
+			response = c.home.Hide(fmt.Sprintf("error: upload failed: %v", err))
+		}
 	default:
 		response = "error: unknown command"
 	}
 	return response
 }
 
+// handleLogin logs the client in and moves it to its home directory.
+func (c *ClientConn) handleLogin(args ...string) string {
+	if c.Users == nil {
+		return "error: this server does not require a login"
+	}
+	user, home, err := login(c.Users, c.Jail, args)
+	if err != nil {
+		c.failures++
+		fmt.Printf("[%s] login failed: %v\n", c.Addr, err)
+		if c.failures >= MaxLoginAttempts {
+			return LoginLimitNotice
+		}
+		return fmt.Sprintf("error: %v", err)
+	}
+	c.user, c.home, c.CurrentDir, c.failures = user, home, "/", 0
+	fmt.Printf("[%s] logged in as %s (%s)\n", c.Addr, user.Name, user.Role)
+	return fmt.Sprintf("logged in as %s (%s)", user.Name, user.Role)
+}
+
 func handleEcho(args ...string) string {
 	return strings.Join(args, " ")
 }
@@ -174,10 +283,14 @@ func handleTime() string {
 	return time.Now().Format("15:04:05.000")
 }
 
-func handleLs(dir string) string {
+func handleLs(jail *Jail, currentDir string) string {
+	dir, _, err := jail.Resolve(currentDir, ".")
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
 	files, err := os.ReadDir(dir)
 	if err != nil {
-		return fmt.Sprintf("error reading directory '%s': %v", dir, err)
+		return fmt.Sprintf("error reading directory '%s'", currentDir)
 	}
 
 	var result []string
@@ -195,22 +308,21 @@ func handleLs(dir string) string {
 	return strings.Join(result, "   ")
 }
 
-func handleCd(currentDir *string, args ...string) string {
+func handleCd(jail *Jail, currentDir *string, args ...string) string {
 	if len(args) == 0 {
 		return "error: path required"
 	}
 
-	newPath := filepath.Join(*currentDir, args[0])
-	absPath, err := filepath.Abs(newPath)
+	realPath, newDir, err := jail.Resolve(*currentDir, args[0])
 	if err != nil {
-		return fmt.Sprintf("error getting absolute path: %v", err)
+		return fmt.Sprintf("error: %v", err)
 	}
 
-	info, err := os.Stat(absPath)
+	info, err := os.Stat(realPath)
 	if err != nil || !info.IsDir() {
-		return fmt.Sprintf("error: path does not exist or is not a directory: %s", absPath)
+		return fmt.Sprintf("error: path does not exist or is not a directory: %s", newDir)
 	}
 
-	*currentDir = absPath
-	return fmt.Sprintf("changed directory to %s", absPath)
+	*currentDir = newDir
+	return fmt.Sprintf("changed directory to %s", newDir)
 }
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"lab_4/tcp"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DrainTimeout is how long a shutdown lets running commands, transfers in
+// particular, finish before their clients are cut off.
+var DrainTimeout = 30 * time.Second
+
+// clientSet tracks the clients being served so a shutdown can reach them.
+// A client is busy from reading a command until it has been answered: idle
+// clients are told about the shutdown and disconnected at once, busy ones
+// as soon as they are done.
+type clientSet struct {
+	clients  map[*tcp.Conn]bool // busy
+	draining bool
+	mu       sync.Mutex
+}
+
+func newClientSet() *clientSet {
+	return &clientSet{clients: make(map[*tcp.Conn]bool)}
+}
+
+// add registers an idle client. It returns false if the server is already
+// shutting down, in which case conn has been told and closed.
+func (c *clientSet) add(conn *tcp.Conn) bool {
+	c.mu.Lock()
+	draining := c.draining
+	if !draining {
+		c.clients[conn] = false
+	}
+	c.mu.Unlock()
+
+	if draining {
+		dismiss(conn)
+	}
+	return !draining
+}
+
+func (c *clientSet) remove(conn *tcp.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.clients, conn)
+}
+
+// begin marks the client busy with a command it has just sent. It returns
+// false if the shutdown disconnected it first; the command is then dropped.
+func (c *clientSet) begin(conn *tcp.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.clients[conn]; !ok {
+		return false
+	}
+	c.clients[conn] = true
+	return true
+}
+
+// end marks the client idle once its command is answered. It returns false
+// if the server started shutting down meanwhile: the client has then been
+// told and disconnected.
+func (c *clientSet) end(conn *tcp.Conn) bool {
+	c.mu.Lock()
+	if _, ok := c.clients[conn]; !ok {
+		c.mu.Unlock()
+		return false
+	}
+	draining := c.draining
+	if draining {
+		delete(c.clients, conn)
+	} else {
+		c.clients[conn] = false
+	}
+	c.mu.Unlock()
+
+	if draining {
+		dismiss(conn)
+	}
+	return !draining
+}
+
+// drain starts a shutdown: idle clients are told and disconnected, and the
+// busy ones will be when they are done. It returns how many are busy.
+func (c *clientSet) drain() int {
+	c.mu.Lock()
+	c.draining = true
+	var idle []*tcp.Conn
+	for conn, busy := range c.clients {
+		if !busy {
+			delete(c.clients, conn)
+			idle = append(idle, conn)
+		}
+	}
+	busy := len(c.clients)
+	c.mu.Unlock()
+
+	for _, conn := range idle {
+		go dismiss(conn)
+	}
+	return busy
+}
+
+// dismiss tells a client the server is shutting down and disconnects it.
+// It is called without the set's lock held, as the notice may take up to
+// NoticeTimeout to write.
+func dismiss(conn *tcp.Conn) {
+	notice(conn, tcp.ShutdownNotice)
+	_ = conn.Close()
+}
+
+// cutOff disconnects the clients still busy, failing their transfers, and
+// returns how many there were.
+func (c *clientSet) cutOff() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.clients)
+	for conn := range c.clients {
+		delete(c.clients, conn)
+		_ = conn.Close()
+	}
+	return n
+}
+
+// awaitShutdown waits for SIGINT or SIGTERM and stops the server: the
+// listener is closed, which ends the accept loop, connected clients are
+// drained and, after DrainTimeout or a second signal, those still busy are
+// cut off. An upload cut off this way has its partial file removed.
+func (s *Server) awaitShutdown() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	sig := <-signals
+	fmt.Printf("received %v, shutting down: %s\n", sig, s.ClientPool.Stats())
+	_ = s.Listener.Close()
+	if busy := s.ClientPool.clients.drain(); busy > 0 {
+		fmt.Printf("waiting up to %s for %d busy clients\n", DrainTimeout, busy)
+	}
+
+	select {
+	case <-time.After(DrainTimeout):
+	case sig = <-signals:
+		fmt.Printf("received %v again\n", sig)
+	}
+	if n := s.ClientPool.clients.cutOff(); n > 0 {
+		fmt.Printf("cut off %d clients\n", n)
+	}
+}
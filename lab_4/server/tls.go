@@ -0,0 +1,27 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"lab_4/tcp"
+)
+
+// announceTLS tells the operator whether connections are encrypted.
+func announceTLS(config *tls.Config) {
+	switch {
+	case config == nil:
+		fmt.Println("warning: TLS is off, commands and files travel in the clear")
+	case config.ClientAuth == tls.RequireAndVerifyClientCert:
+		fmt.Println("TLS on, client certificates required")
+	default:
+		fmt.Println("TLS on")
+	}
+}
+
+// peer describes the client certificate of conn, if any, for the log.
+func peer(conn *tcp.Conn) string {
+	if name := tcp.PeerName(conn.Conn); name != "" {
+		return fmt.Sprintf(" (certificate %s)", name)
+	}
+	return ""
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package tcp
+
+// noFollow is not available everywhere off Linux; O_EXCL and the Lstat
+// checks of the callers have to do there.
+const noFollow = 0
@@ -2,10 +2,16 @@ package tcp
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -13,9 +19,29 @@ import (
 
 const (
 	Port          = 8000
+	ProgressWidth = 50
+)
+
+// KeepaliveIdle and BufferSize, the largest data frame sent, can be
+// changed in the configuration.
+var (
 	KeepaliveIdle = 30 * time.Second
 	BufferSize    = 128 * 1024
-	ProgressWidth = 50
+)
+
+// ShutdownNotice is what a server sends its clients instead of an answer
+// when it is going away.
+const ShutdownNotice = "error: server shutting down"
+
+// HashAlgorithm is the checksum the sender announces in transfer metadata.
+var HashAlgorithm = "sha256"
+
+// Frame types used for the file body that follows the "name|size" metadata line.
+const (
+	FrameData       byte = 'D'
+	FrameEOF        byte = 'E'
+	FrameError      byte = 'X'
+	FrameHeaderSize      = 5
 )
 
 func SetKeepalive(conn net.Conn) error {
@@ -32,24 +58,80 @@ func SetKeepalive(conn net.Conn) error {
 	return nil
 }
 
-func SendData(conn net.Conn, data string) error {
-	if _, err := fmt.Fprintln(conn, data); err != nil {
+// SendData writes one line and flushes it.
+func SendData(conn *Conn, data string) error {
+	if _, err := fmt.Fprintln(conn.Writer, data); err != nil {
+		return fmt.Errorf("error writing to connection: %v", err)
+	}
+	if err := conn.Flush(); err != nil {
 		return fmt.Errorf("error writing to connection: %v", err)
 	}
 	return nil
 }
 
-func ReadData(conn net.Conn) (string, error) {
-	reader := bufio.NewReader(conn)
-
-	data, err := reader.ReadString('\n')
+// ReadData reads one line from the connection's buffered reader, leaving
+// whatever follows it for the next read.
+func ReadData(conn *Conn) (string, error) {
+	data, err := conn.Reader.ReadString('\n')
 	if err != nil {
-		return "", fmt.Errorf("error reading data: %v", err)
+		return "", fmt.Errorf("error reading data: %w", err)
 	}
 
 	return strings.TrimSpace(data), nil
 }
 
+// WriteFrame writes a 1-byte frame type, a 4-byte big-endian payload length
+// and the payload itself.
+func WriteFrame(w io.Writer, frameType byte, payload []byte) error {
+	header := make([]byte, FrameHeaderSize)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("error writing frame header: %v", err)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	if _, err := w.Write(payload); err != nil {
+		return fmt.Errorf("error writing frame payload: %v", err)
+	}
+	return nil
+}
+
+// Discard reads and drops an incoming file, metadata and frames, that will
+// not be stored, so the connection stays in step with the sender.
+func Discard(conn *Conn) error {
+	metaData, err := ReadData(conn)
+	if err != nil || strings.HasPrefix(metaData, "error") {
+		return err
+	}
+	return discardFrames(conn.Reader)
+}
+
+// discardFrames drops frames up to and including the eof or error frame.
+func discardFrames(reader *bufio.Reader) error {
+	for {
+		frameType, length, err := ReadFrameHeader(reader)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, reader, int64(length)); err != nil {
+			return err
+		}
+		if frameType != FrameData {
+			return nil
+		}
+	}
+}
+
+func ReadFrameHeader(r io.Reader) (byte, uint32, error) {
+	header := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, fmt.Errorf("error reading frame header: %v", err)
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:]), nil
+}
+
 func GetIP() (string, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
@@ -83,84 +165,139 @@ func IsWirelessInterface(name string) bool {
 		name == "Беспроводная сеть"
 }
 
-func Download(localDir string, conn net.Conn, args ...string) {
+// Download receives one file into localDir and returns the path it was
+// written to, which may differ from the name asked for; see CreateUnique.
+func Download(localDir string, conn *Conn, args ...string) (string, error) {
+	reader := conn.Reader
+
 	metaData, err := ReadData(conn)
 	if err != nil {
-		fmt.Printf("error receiving metadata: %v\n", err)
-		return
+		return "", fmt.Errorf("error receiving metadata: %v", err)
+	}
+	if strings.HasPrefix(metaData, "error") {
+		return "", fmt.Errorf("sender: %s", strings.TrimPrefix(metaData, "error: "))
 	}
 	metaParts := strings.Split(metaData, "|")
-	if len(metaParts) != 2 {
-		fmt.Println("error: invalid metadata format")
-		return
+	if len(metaParts) != 3 {
+		return "", fmt.Errorf("invalid metadata format")
+	}
+	// The name the sender announces is only ever a base name: it must
+	// not place the file outside localDir.
+	fileName := path.Base(strings.ReplaceAll(metaParts[0], "\\", "/"))
+	if len(args) > 0 {
+		fileName = args[0]
+	}
+	// Once the metadata is in, the sender goes on with its frames whatever
+	// happens here; they are read past so the next command is read in step.
+	skip := func(err error) (string, error) {
+		_ = discardFrames(reader)
+		return "", err
+	}
+	if fileName == "." || fileName == ".." || fileName == "/" {
+		return skip(fmt.Errorf("invalid file name %q", metaParts[0]))
 	}
-	fileName := metaParts[0]
 	var fileSize int64
 	_, err = fmt.Sscanf(metaParts[1], "%d", &fileSize)
 	if err != nil {
-		fmt.Printf("error parsing file size: %v\n", err)
-		return
+		return skip(fmt.Errorf("error parsing file size: %v", err))
+	}
+	algorithm, expectedSum, err := ParseChecksum(metaParts[2])
+	if err != nil {
+		return skip(err)
+	}
+	hasher, err := NewHash(algorithm)
+	if err != nil {
+		return skip(err)
 	}
-	localFilePath := filepath.Join(localDir, fileName)
-	localFilePath = GetUniqueFileName(localFilePath)
 
-	file, err := os.Create(localFilePath)
+	file, localFilePath, err := CreateUnique(filepath.Join(localDir, fileName))
 	if err != nil {
-		fmt.Printf("error creating file: %v\n", err)
-		return
+		return skip(fmt.Errorf("error creating file: %v", err))
 	}
 	defer func(file *os.File) {
 		_ = file.Close()
 	}(file)
+	// A transfer cannot be resumed, so a partial file is of no use.
+	discard := func() {
+		_ = file.Close()
+		_ = os.Remove(localFilePath)
+	}
 
-	buffer := make([]byte, BufferSize)
-	var receivedBytes int64
 	startTime := time.Now()
+	receivedBytes, err := receiveFrames(reader, io.MultiWriter(file, hasher), fileSize, startTime)
+	if receivedBytes > 0 {
+		fmt.Println()
+	}
+	if err != nil {
+		discard()
+		return "", err
+	}
 
+	if receivedBytes != fileSize {
+		discard()
+		return "", fmt.Errorf("incomplete transfer, received %d of %d bytes", receivedBytes, fileSize)
+	}
+	if actualSum := hex.EncodeToString(hasher.Sum(nil)); actualSum != expectedSum {
+		discard()
+		return "", fmt.Errorf("%s checksum mismatch, removed %s", algorithm, localFilePath)
+	}
+
+	duration := time.Since(startTime)
+	speed := float64(receivedBytes) / duration.Seconds() / 1024 // KB/s
+	fmt.Printf("download completed: %d bytes in %.2f seconds (%.2f KB/s), %s verified\n",
+		receivedBytes, duration.Seconds(), speed, algorithm)
+	return localFilePath, nil
+}
+
+// receiveFrames copies data frames into w until the eof frame and returns
+// the running byte count.
+func receiveFrames(reader *bufio.Reader, w io.Writer, fileSize int64, startTime time.Time) (int64, error) {
+	var receivedBytes int64
 	for {
-		n, err := conn.Read(buffer)
+		frameType, length, err := ReadFrameHeader(reader)
 		if err != nil {
-			if n == 0 && err == io.EOF {
-				break
-			}
-			fmt.Printf("error reading data: %v\n", err)
-			return
+			return receivedBytes, err
 		}
-		data := string(buffer[:n])
-		if strings.Contains(data, "[EOF]") {
-			eofIndex := strings.Index(data, "[EOF]")
-			_, err = file.Write(buffer[:eofIndex])
-			if err != nil {
-				fmt.Printf("error writing to file: %v\n", err)
+
+		switch frameType {
+		case FrameData:
+			if receivedBytes+int64(length) > fileSize {
+				return receivedBytes, fmt.Errorf("received more than %d announced bytes", fileSize)
 			}
-			break
-		}
-		_, err = file.Write(buffer[:n])
-		if err != nil {
-			fmt.Printf("error writing to file: %v\n", err)
-			return
+			if _, err := io.CopyN(w, reader, int64(length)); err != nil {
+				return receivedBytes, fmt.Errorf("error writing to file: %v", err)
+			}
+			receivedBytes += int64(length)
+			PrintProgress(receivedBytes, fileSize, startTime)
+		case FrameEOF:
+			return receivedBytes, nil
+		case FrameError:
+			message := make([]byte, length)
+			if _, err := io.ReadFull(reader, message); err != nil {
+				return receivedBytes, fmt.Errorf("error reading error frame: %v", err)
+			}
+			return receivedBytes, fmt.Errorf("error from sender: %s", message)
+		default:
+			return receivedBytes, fmt.Errorf("unknown frame type %q", frameType)
 		}
-		receivedBytes += int64(n)
-		PrintProgress(receivedBytes, fileSize, startTime)
 	}
-
-	duration := time.Since(startTime)
-	speed := float64(receivedBytes) / duration.Seconds() / 1024 // KB/s
-	fmt.Printf("\ndownload completed: %d bytes in %.2f seconds (%.2f KB/s)\n",
-		receivedBytes, duration.Seconds(), speed)
 }
 
-func Upload(localDir string, conn net.Conn, args ...string) {
+func Upload(localDir string, conn *Conn, args ...string) error {
+	defer func() {
+		_ = conn.Flush()
+	}()
+
 	if len(args) == 0 {
 		_ = SendData(conn, "error: file name required")
-		return
+		return fmt.Errorf("file name required")
 	}
 	localFileName := args[0]
 	localFilePath := filepath.Join(localDir, localFileName)
 	file, err := os.Open(localFilePath)
 	if err != nil {
 		_ = SendData(conn, "error: failed to open file")
-		return
+		return fmt.Errorf("failed to open file: %v", err)
 	}
 	defer func(file *os.File) {
 		_ = file.Close()
@@ -169,44 +306,100 @@ func Upload(localDir string, conn net.Conn, args ...string) {
 	fileInfo, err := file.Stat()
 	if err != nil {
 		_ = SendData(conn, "error: failed to get file info")
-		return
+		return fmt.Errorf("failed to get file info: %v", err)
 	}
 	totalBytes := fileInfo.Size()
 
-	metaData := fmt.Sprintf("%s|%d", localFileName, totalBytes)
+	checksum, err := HashFile(io.LimitReader(file, totalBytes), HashAlgorithm)
+	if err != nil {
+		_ = SendData(conn, "error: failed to hash file")
+		return fmt.Errorf("failed to hash file: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		_ = SendData(conn, "error: failed to seek file")
+		return fmt.Errorf("failed to seek file: %v", err)
+	}
+
+	metaData := fmt.Sprintf("%s|%d|%s", localFileName, totalBytes, checksum)
 	err = SendData(conn, metaData)
 	if err != nil {
-		fmt.Printf("error sending metadata: %v\n", err)
-		return
+		return fmt.Errorf("error sending metadata: %v", err)
 	}
 
-	buffer := make([]byte, BufferSize)
-	var sentBytes int64
 	startTime := time.Now()
+	sentBytes, err := sendFrames(conn, io.LimitReader(file, totalBytes), totalBytes, startTime)
+	if sentBytes > 0 {
+		fmt.Println()
+	}
+	if err != nil {
+		return err
+	}
 
+	duration := time.Since(startTime)
+	speed := float64(totalBytes) / duration.Seconds() / 1024
+	fmt.Printf("upload completed: %d bytes in %.2f seconds (%.2f KB/s)\n",
+		totalBytes, duration.Seconds(), speed)
+	return nil
+}
+
+// sendFrames sends source as data frames followed by the eof frame and
+// returns the running byte count.
+func sendFrames(conn io.Writer, source io.Reader, totalBytes int64, startTime time.Time) (int64, error) {
+	buffer := make([]byte, BufferSize)
+	var sentBytes int64
 	for {
-		n, err := file.Read(buffer)
+		n, err := source.Read(buffer)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			fmt.Printf("error reading file: %v\n", err)
-			return
+			_ = WriteFrame(conn, FrameError, []byte("failed to read file"))
+			return sentBytes, fmt.Errorf("error reading file: %v", err)
 		}
-		_, err = conn.Write(buffer[:n])
-		if err != nil {
-			fmt.Printf("error sending data: %v\n", err)
-			return
+		if err := WriteFrame(conn, FrameData, buffer[:n]); err != nil {
+			return sentBytes, fmt.Errorf("error sending data: %v", err)
 		}
 		sentBytes += int64(n)
 		PrintProgress(sentBytes, totalBytes, startTime)
 	}
 
-	_, _ = conn.Write([]byte("[EOF]"))
-	duration := time.Since(startTime)
-	speed := float64(totalBytes) / duration.Seconds() / 1024
-	fmt.Printf("\nupload completed: %d bytes in %.2f seconds (%.2f KB/s)\n",
-		totalBytes, duration.Seconds(), speed)
+	if err := WriteFrame(conn, FrameEOF, nil); err != nil {
+		return sentBytes, fmt.Errorf("error sending eof: %v", err)
+	}
+	return sentBytes, nil
+}
+
+// NewHash returns a hasher for one of the checksum algorithms accepted in
+// transfer metadata.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
+
+// HashFile returns the "algorithm:hexdigest" checksum of r.
+func HashFile(r io.Reader, algorithm string) (string, error) {
+	hasher, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return algorithm + ":" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func ParseChecksum(checksum string) (string, string, error) {
+	algorithm, sum, ok := strings.Cut(checksum, ":")
+	if !ok || sum == "" {
+		return "", "", fmt.Errorf("invalid checksum %q", checksum)
+	}
+	return algorithm, strings.ToLower(sum), nil
 }
 
 func PrintProgress(current, total int64, startTime time.Time) {
@@ -228,7 +421,7 @@ func PrintProgress(current, total int64, startTime time.Time) {
 }
 
 func GetUniqueFileName(filePath string) string {
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	if _, err := os.Lstat(filePath); os.IsNotExist(err) {
 		return filePath
 	}
 
@@ -239,9 +432,23 @@ func GetUniqueFileName(filePath string) string {
 	for {
 		newFileName := fmt.Sprintf("%s(%d)%s", base, i, ext)
 		newPath := filepath.Join(dir, newFileName)
-		if _, err := os.Stat(newPath); os.IsNotExist(err) {
+		if _, err := os.Lstat(newPath); os.IsNotExist(err) {
 			return newPath
 		}
 		i++
 	}
 }
+
+// CreateUnique creates a new file at filePath, or under the first free
+// name GetUniqueFileName finds, and returns it with its path. It never
+// opens an entry that is already there, so a symlink in the way, even a
+// dangling one, cannot redirect the file elsewhere.
+func CreateUnique(filePath string) (*os.File, string, error) {
+	for {
+		name := GetUniqueFileName(filePath)
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL|noFollow, 0666)
+		if !os.IsExist(err) {
+			return file, name, err
+		}
+	}
+}